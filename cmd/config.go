@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/signals"
+	tokenrefresher "github.com/SumoLogic-Labs/service-account-token-refresher/pkg/token-refresher"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const defaultEnvPrefix = "TOKEN_REFRESHER_"
+
+type config struct {
+	tokenrefresher.TokenRefresher `mapstructure:",squash"`
+	LogLevel                      string        `mapstructure:"log_level"`
+	ConfigFile                    string        `mapstructure:"config"`
+	EnvPrefix                     string        `mapstructure:"env_prefix"`
+	Profile                       string        `mapstructure:"profile"`
+	Signals                       []string      `mapstructure:"signals"`
+	SignalStopCount               int           `mapstructure:"signal_stop_count"`
+	SignalForceCount              int           `mapstructure:"signal_force_count"`
+	SignalWindow                  time.Duration `mapstructure:"signal_window"`
+}
+
+var conf *config
+
+// initConfig loads the config from flags, env vars and the optional config file.
+// Any error is fatal as running with a partially applied config is worse than not running at all.
+func initConfig(flags *pflag.FlagSet) {
+	var err error
+	conf, err = loadConfig()
+	if err != nil {
+		logger.Errorf("unable to load config: %s", err.Error())
+		os.Exit(1)
+	}
+	logger.SetLevel(conf.level())
+	logSources(flags)
+}
+
+// legacyEnvKeys are the settings which were read from unprefixed env vars before the prefix was introduced
+var legacyEnvKeys = map[string]bool{
+	"namespace":           true,
+	"service_account":     true,
+	"kubeconfig":          true,
+	"default_token_file":  true,
+	"token_file":          true,
+	"token_audience":      true,
+	"expiration_duration": true,
+	"refresh_interval":    true,
+	"shutdown_interval":   true,
+	"max_attempts":        true,
+	"sleep":               true,
+}
+
+// bindEnv binds every flag to its prefixed env var, e.g. TOKEN_REFRESHER_NAMESPACE for --namespace.
+// The unprefixed env vars of the legacy settings are still read as a fallback, but are deprecated.
+// Later settings are only read from the prefixed env vars, as generic names like PROFILE or SOURCE are likely to be set for something else.
+func bindEnv() {
+	prefix := viper.GetString("env_prefix")
+	for _, key := range settingKeys(rootCmd.PersistentFlags()) {
+		names := []string{key, envName(prefix, key)}
+		if prefix != "" && legacyEnvKeys[key] {
+			names = append(names, envName("", key))
+		}
+		viper.BindEnv(names...)
+	}
+}
+
+func envName(prefix, key string) string {
+	return strings.ToUpper(prefix + key)
+}
+
+// settingKeys returns the keys of all settings which can be read from env vars
+func settingKeys(flags *pflag.FlagSet) []string {
+	var keys []string
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name != "env_prefix" && f.Name != "help" {
+			keys = append(keys, f.Name)
+		}
+	})
+	return keys
+}
+
+type setting struct {
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value"`
+	Source     string      `json:"source"`
+	Deprecated bool        `json:"deprecated,omitempty"`
+	// Overridden are the other sources which set the setting as well, but lost by precedence
+	Overridden []string `json:"overridden,omitempty"`
+}
+
+// settings returns every effective setting along with the source it was read from.
+// The order of precedence is flag, env var, config file, profile and default.
+func settings(flags *pflag.FlagSet) []setting {
+	prefix := viper.GetString("env_prefix")
+	var ss []setting
+	for _, key := range settingKeys(flags) {
+		s := setting{Key: key, Value: viper.Get(key)}
+		var sources []string
+		if f := flags.Lookup(key); f != nil && f.Changed {
+			sources = append(sources, "flag --"+key)
+		}
+		if _, ok := os.LookupEnv(envName(prefix, key)); ok {
+			sources = append(sources, "env "+envName(prefix, key))
+		}
+		if _, ok := os.LookupEnv(envName("", key)); ok && prefix != "" && legacyEnvKeys[key] {
+			s.Deprecated = len(sources) == 0
+			sources = append(sources, "env "+envName("", key))
+		}
+		if viper.InConfig(key) {
+			sources = append(sources, "file "+viper.ConfigFileUsed())
+		}
+		_, fromProfile := profileDefaults[key]
+		switch {
+		case len(sources) > 0:
+			s.Source, s.Overridden = sources[0], sources[1:]
+		case fromProfile:
+			s.Source = "profile " + viper.GetString("profile")
+		default:
+			s.Source = "default"
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// logSources logs the source of every setting and warns about deprecated env vars
+// and settings which are set by conflicting sources
+func logSources(flags *pflag.FlagSet) {
+	prefix := viper.GetString("env_prefix")
+	lines := []string{"Effective settings:"}
+	for _, s := range settings(flags) {
+		lines = append(lines, fmt.Sprintf("  %s=%v (%s)", s.Key, s.Value, s.Source))
+		if s.Deprecated {
+			logger.Warnf("Env var %s is deprecated, use %s instead", envName("", s.Key), envName(prefix, s.Key))
+		}
+		if len(s.Overridden) > 0 {
+			logger.Warnf("Setting %s is taken from %s, ignoring the conflicting %s", s.Key, s.Source, strings.Join(s.Overridden, ", "))
+		}
+	}
+	logger.Infof("%s", strings.Join(lines, "\n"))
+}
+
+// loadConfig (re-)reads the config file, if any, and strictly decodes the effective config
+func loadConfig() (*config, error) {
+	if file := viper.GetString("config"); file != "" {
+		viper.SetConfigFile(file)
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("unable to read config file %s: %w", file, err)
+		}
+	}
+	if err := applyProfile(viper.GetString("profile")); err != nil {
+		return nil, err
+	}
+	c := new(config)
+	if err := viper.UnmarshalExact(c); err != nil {
+		return nil, fmt.Errorf("unable to decode into config struct: %w", err)
+	}
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		return nil, err
+	}
+	if _, err := c.signalConfig(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// profileDefaults holds the settings defaulted by the selected profile
+var profileDefaults map[string]interface{}
+
+// applyProfile replaces the defaults of the previously applied profile, if any, with those of the given one.
+// Flags, env vars and the config file still take precedence.
+func applyProfile(name string) error {
+	for key := range profileDefaults {
+		viper.SetDefault(key, nil)
+	}
+	profileDefaults = nil
+	if name == "" {
+		return nil
+	}
+	p, err := tokenrefresher.GetProfile(name)
+	if err != nil {
+		return err
+	}
+	profileDefaults = map[string]interface{}{
+		"default_token_file":  p.TokenFile(),
+		"expiration_duration": p.ExpirationDuration,
+		"refresh_interval":    p.RefreshInterval,
+	}
+	if len(p.TokenAudience) > 0 {
+		profileDefaults["token_audience"] = p.TokenAudience
+	}
+	for key, value := range profileDefaults {
+		viper.SetDefault(key, value)
+	}
+	return nil
+}
+
+// signalConfig returns the stages of the shutdown signal handling
+func (c *config) signalConfig() (signals.Config, error) {
+	sigs, err := signals.ParseAll(c.Signals)
+	if err != nil {
+		return signals.Config{}, err
+	}
+	if len(sigs) == 0 {
+		return signals.Config{}, fmt.Errorf("at least one signal is required")
+	}
+	for _, sig := range sigs {
+		if sig == signals.ForceRefresh || sig == signals.Reload || sig == signals.DumpState {
+			return signals.Config{}, fmt.Errorf("%s is a control signal and cannot be a shutdown signal", sig)
+		}
+	}
+	if c.SignalStopCount < 0 || c.SignalForceCount < 0 {
+		return signals.Config{}, fmt.Errorf("signal counts must not be negative")
+	}
+	if c.SignalWindow <= 0 {
+		return signals.Config{}, fmt.Errorf("signal window must be positive, got %v", c.SignalWindow)
+	}
+	return signals.Config{
+		Signals:    sigs,
+		StopCount:  c.SignalStopCount,
+		ForceCount: c.SignalForceCount,
+		Window:     c.SignalWindow,
+	}, nil
+}
+
+func (c *config) level() logger.Level {
+	level, _ := logger.ParseLevel(c.LogLevel)
+	return level
+}
+
+// watchConfig applies changes of the config file to the running refresher until the returned stop is called.
+// The file is only read by reloadConfig, so that reads by the watch and by SIGHUP are serialized by reloadMu.
+func watchConfig(refresher *tokenrefresher.TokenRefresher) (stop func()) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return func() {}
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Errorf("unable to watch config file %s: %s", file, err.Error())
+		return func() {}
+	}
+	// the directory is watched, as a mounted ConfigMap replaces the file by swapping a symlink
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		w.Close()
+		logger.Errorf("unable to watch config file %s: %s", file, err.Error())
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer w.Close()
+		target, _ := filepath.EvalSymlinks(file)
+		for {
+			select {
+			case e := <-w.Events:
+				current, _ := filepath.EvalSymlinks(file)
+				changed := filepath.Clean(e.Name) == filepath.Clean(file) && e.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if !changed && current == target {
+					continue
+				}
+				target = current
+				logger.Infof("Config file changed: %s", e.Name)
+				reloadConfig(refresher)
+			case err := <-w.Errors:
+				logger.Errorf("unable to watch config file %s: %s", file, err.Error())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// reloadMu serializes reloads, which are triggered both by config file changes and by SIGHUP.
+// Viper and the profile defaults are not safe for concurrent use.
+var reloadMu sync.Mutex
+
+// reloadConfig reloads the config and applies it to the running refresher.
+// Invalid changes are rejected and the last good config is kept.
+func reloadConfig(refresher *tokenrefresher.TokenRefresher) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c, err := loadConfig()
+	if err != nil {
+		logger.Errorf("Rejected config reload: %s", err.Error())
+		return
+	}
+	if err := refresher.Reload(&c.TokenRefresher); err != nil {
+		logger.Errorf("Rejected config reload: %s", err.Error())
+		return
+	}
+	logger.SetLevel(c.level())
+	logger.Infof("Log level: %s", c.level())
+}
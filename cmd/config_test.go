@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/signals"
+	tokenrefresher "github.com/SumoLogic-Labs/service-account-token-refresher/pkg/token-refresher"
+
+	"github.com/spf13/viper"
+)
+
+func writeConfig(t *testing.T, file string, maxAttempts int) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(fmt.Sprintf("max_attempts: %d\n", maxAttempts)), 0600); err != nil {
+		t.Fatalf("unable to write config: %s", err.Error())
+	}
+}
+
+func waitForMaxAttempts(t *testing.T, refresher *tokenrefresher.TokenRefresher, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for refresher.State().MaxAttempts != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("want max attempts %d reloaded, got %d", want, refresher.State().MaxAttempts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Run with -race: the watch and SIGHUP both read the config file into viper
+func TestWatchConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, file, 2)
+	viper.Set("config", file)
+	t.Cleanup(func() {
+		viper.Set("config", "")
+		viper.SetConfigFile("")
+	})
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %s", err.Error())
+	}
+	refresher := &c.TokenRefresher
+	stopWatch := watchConfig(refresher)
+	defer stopWatch()
+	stopControl := signals.Handle(context.Background(), logger.Std, map[os.Signal]func(){
+		signals.Reload: func() { reloadConfig(refresher) },
+	})
+	defer stopControl()
+
+	t.Run("watchConfig() should reload a changed config file", func(t *testing.T) {
+		writeConfig(t, file, 3)
+		waitForMaxAttempts(t, refresher, 3)
+	})
+
+	t.Run("watchConfig() should reload along with SIGHUP", func(t *testing.T) {
+		self, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			t.Fatalf("unable to find own process: %s", err.Error())
+		}
+		for i := 4; i < 40; i++ {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				self.Signal(signals.Reload)
+			}()
+			writeConfig(t, file, i)
+			<-done
+			waitForMaxAttempts(t, refresher, i)
+		}
+	})
+}
+
+func TestBindEnv(t *testing.T) {
+	t.Setenv("NAMESPACE", "legacy")
+	t.Setenv("PROFILE", "injected")
+	t.Setenv("SOURCE", "injected")
+	bindEnv()
+	flags := rootCmd.PersistentFlags()
+
+	t.Run("bindEnv() should fall back to the unprefixed env var of a legacy setting", func(t *testing.T) {
+		if got := viper.GetString("namespace"); got != "legacy" {
+			t.Errorf("want namespace %q, got %q", "legacy", got)
+		}
+	})
+
+	t.Run("bindEnv() should ignore the unprefixed env vars of later settings", func(t *testing.T) {
+		for _, key := range []string{"profile", "source"} {
+			if got, want := viper.GetString(key), flags.Lookup(key).DefValue; got != want {
+				t.Errorf("want %s %q, got %q", key, want, got)
+			}
+		}
+	})
+
+	t.Run("settings() should only report the legacy env var as deprecated", func(t *testing.T) {
+		for _, s := range settings(flags) {
+			switch s.Key {
+			case "namespace":
+				if s.Source != "env NAMESPACE" || !s.Deprecated {
+					t.Errorf("want namespace from deprecated env NAMESPACE, got %+v", s)
+				}
+			case "profile", "source":
+				if s.Source != "default" || s.Deprecated {
+					t.Errorf("want %s from default, got %+v", s.Key, s)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the effective configuration",
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the effective configuration",
+	Long:  `Loads the effective configuration from flags, env vars and the config file the same way the refresher does, fills in settings discovered from the pod and checks it, exiting non-zero if it is invalid.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := loadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to load config: %s\n", err.Error())
+			os.Exit(1)
+		}
+		offline, _ := cmd.Flags().GetBool("offline")
+		if !offline {
+			c.Discover()
+		}
+		errs := []error{c.Validate()}
+		if !offline {
+			errs = append(errs, c.CheckShutdownDir())
+		}
+		if err := errors.Join(errs...); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config:\n%s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Config is valid")
+	},
+}
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Print the effective configuration along with the source of every setting",
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := loadConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to load config: %s\n", err.Error())
+			os.Exit(1)
+		}
+		ss := settings(cmd.Root().PersistentFlags())
+		if output, _ := cmd.Flags().GetString("output"); output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(ss)
+			return
+		}
+		// Values are json encoded, which makes the output a valid config file
+		for _, s := range ss {
+			v, err := json.Marshal(dumpValue(s.Value))
+			if err != nil {
+				v = []byte(fmt.Sprintf("%q", fmt.Sprint(s.Value)))
+			}
+			fmt.Printf("%s: %s # %s\n", s.Key, v, s.Source)
+		}
+	},
+}
+
+func dumpValue(v interface{}) interface{} {
+	if d, ok := v.(time.Duration); ok {
+		return d.String()
+	}
+	return v
+}
+
+func init() {
+	validateCmd.Flags().Bool("offline", false, "skip discovery and checks against the local filesystem, e.g. when validating manifests in CI")
+	dumpCmd.Flags().StringP("output", "o", "yaml", "output format: yaml or json")
+	configCmd.AddCommand(validateCmd, dumpCmd)
+	rootCmd.AddCommand(configCmd)
+}
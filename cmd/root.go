@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
 	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/signals"
 	tokenrefresher "github.com/SumoLogic-Labs/service-account-token-refresher/pkg/token-refresher"
 
@@ -14,27 +17,46 @@ import (
 	"k8s.io/client-go/util/homedir"
 )
 
-type config struct {
-	tokenrefresher.TokenRefresher `mapstructure:",squash"`
-}
-
-var conf *config
-
 var rootCmd = &cobra.Command{
 	Use:   "token-refresher",
 	Short: "Automatic token refresher for terminating pods",
 	Long:  `A sidecar which starts auto-refreshing the service account token when the default one is close to expiry or container receives a shutdown signal.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		stopCh := signals.SignalShutdown()
-		refresher := conf.TokenRefresher
-		if err := refresher.Run(stopCh); err != nil {
-			fmt.Printf("unable to run: %s", err.Error())
+		initConfig(cmd.Root().PersistentFlags())
+		signalConfig, err := conf.signalConfig()
+		if err != nil {
+			logger.Errorf("unable to load config: %s", err.Error())
+			os.Exit(1)
+		}
+		shutdown := signals.NotifyShutdown(context.Background(), signalConfig)
+		defer shutdown.Close()
+		refresher := &conf.TokenRefresher
+		refresher.Apply(tokenrefresher.WithSignal(shutdown.Triggered().Done()))
+		stopWatch := watchConfig(refresher)
+		defer stopWatch()
+		stopControl := signals.Handle(context.Background(), logger.Std, map[os.Signal]func(){
+			signals.ForceRefresh: refresher.ForceRefresh,
+			signals.Reload:       func() { reloadConfig(refresher) },
+			signals.DumpState:    func() { dumpState(refresher) },
+		})
+		defer stopControl()
+		if _, err := refresher.Run(shutdown.Stopped()); err != nil {
+			logger.Errorf("unable to run: %s", err.Error())
 			os.Exit(2)
 		}
-		fmt.Println("Exiting")
 	},
 }
 
+// dumpState prints a snapshot of the refresher's state to stdout
+func dumpState(refresher *tokenrefresher.TokenRefresher) {
+	b, err := json.MarshalIndent(refresher.State(), "", "  ")
+	if err != nil {
+		logger.Errorf("unable to encode state: %s", err.Error())
+		return
+	}
+	fmt.Println(string(b))
+}
+
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
@@ -43,34 +65,85 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
+	cobra.OnInitialize(bindEnv)
+
+	rootCmd.PersistentFlags().String("config", "", "path to a YAML or JSON config file with the same keys as the flags, changes are applied live where possible")
+	rootCmd.PersistentFlags().String("env_prefix", defaultEnvPrefix, "prefix of the env vars corresponding to the flags, e.g. TOKEN_REFRESHER_NAMESPACE for --namespace")
+
+	rootCmd.PersistentFlags().String("profile", "", fmt.Sprintf("preset of default token file, audience, expiration and refresh interval for a cloud provider, one of %v", tokenrefresher.ProfileNames()))
 
 	// The flag names must match those from conf.TokenRefresher
-	rootCmd.Flags().StringP("namespace", "n", "", "current namespace")
-	rootCmd.Flags().StringP("service_account", "s", "", "name of service account to issue token for")
-	rootCmd.Flags().String("default_token_file", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token", "path to default service account token file")
-	rootCmd.Flags().String("token_file", "/var/run/secrets/token-refresher/token", "path to self-managed service account token file")
-	rootCmd.Flags().StringSlice("token_audience", []string{"sts.amazonaws.com"}, "comma separated token audience")
-	rootCmd.Flags().Duration("expiration_duration", time.Hour*2, "token expiry duration")
-	rootCmd.Flags().Duration("refresh_interval", time.Hour*1, "token refresh interval")
-	rootCmd.Flags().Duration("shutdown_interval", time.Minute*1, "token refresher shutdown check interval")
-	rootCmd.Flags().Int("max_attempts", 3, "max retries on token refresh failure")
-	rootCmd.Flags().Duration("sleep", time.Second*20, "sleep duration between retries")
+	rootCmd.PersistentFlags().StringP("namespace", "n", "", "current namespace, discovered from the pod if unset")
+	rootCmd.PersistentFlags().StringP("service_account", "s", "", "name of service account to issue token for, discovered from the default token if unset")
+	rootCmd.PersistentFlags().String("default_token_file", tokenrefresher.DefaultProjectedFile, "path to default service account token file, defaults to the profile's token file if a profile is set")
+	rootCmd.PersistentFlags().String("token_file", tokenrefresher.DefaultTokenFile, "path to self-managed service account token file")
+	rootCmd.PersistentFlags().StringSlice("token_audience", nil, "comma separated token audience, discovered from the default token if unset")
+	rootCmd.PersistentFlags().Duration("expiration_duration", 0, "token expiry duration, discovered from the default token if unset, else 2h")
+	rootCmd.PersistentFlags().Bool("eks_annotations", false, "adopt token audience and expiration from the eks.amazonaws.com annotations of the service account if unset, needs get on serviceaccounts")
+	rootCmd.PersistentFlags().Duration("refresh_interval", tokenrefresher.DefaultRefreshInterval, "token refresh interval")
+	rootCmd.PersistentFlags().Duration("shutdown_interval", tokenrefresher.DefaultShutdownInterval, "token refresher shutdown check interval")
+	rootCmd.PersistentFlags().String("shutdown_file", "", "path of the file which tells the refresher to stop, defaults to shutdown in the directory of token_file")
+	rootCmd.PersistentFlags().StringSlice("shutdown_signalers", nil, "comma separated names of containers which each write their own <shutdown_file>.<name>, refreshing stops once all of them have")
+	rootCmd.PersistentFlags().Bool("shutdown_instructions", false, "parse the shutdown files as instructions: stop now, stop after <duration> or stop at <RFC3339 time>")
+	rootCmd.PersistentFlags().Int("max_attempts", tokenrefresher.DefaultMaxAttempts, "max retries on token refresh failure")
+	rootCmd.PersistentFlags().Duration("sleep", tokenrefresher.DefaultRetrySleep, "sleep duration between retries")
+	rootCmd.PersistentFlags().StringSlice("signals", []string{"SIGTERM", "SIGINT"}, "comma separated shutdown signals, the first one starts refreshing")
+	rootCmd.PersistentFlags().Int("signal_stop_count", 2, "number of shutdown signals within signal_window which gracefully stop refreshing, 0 disables")
+	rootCmd.PersistentFlags().Int("signal_force_count", 3, "number of shutdown signals within signal_window which force the refresher to exit, 0 disables")
+	rootCmd.PersistentFlags().Duration("signal_window", time.Second*10, "window in which shutdown signals are counted")
+	rootCmd.PersistentFlags().String("log_level", "info", "log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringSlice("sinks", []string{tokenrefresher.SinkFile}, fmt.Sprintf("comma separated sinks to write refreshed tokens to, any of %v", tokenrefresher.SinkNames()))
+	rootCmd.PersistentFlags().String("sink_policy", tokenrefresher.SinkPolicyAll, "a refresh succeeds once all or any of the sinks were written")
+	rootCmd.PersistentFlags().String("sink_command", "", "command run in a shell by the exec sink with the token on stdin and TOKEN_REFRESHER_EXPIRES_AT in its environment")
+	rootCmd.PersistentFlags().Duration("sink_timeout", tokenrefresher.DefaultSinkTimeout, "timeout of writing the token to a single sink")
+	rootCmd.PersistentFlags().String("secret_name", "", "name of the secret to write refreshed tokens to")
+	rootCmd.PersistentFlags().String("secret_key", tokenrefresher.DefaultSecretKey, "key of the secret to write refreshed tokens to")
+	rootCmd.PersistentFlags().String("pod_name", "", "name of the current pod, owns the secret so that it is garbage-collected with the pod")
+	rootCmd.PersistentFlags().StringSlice("triggers", tokenrefresher.DefaultTriggers, fmt.Sprintf("comma separated triggers to start refreshing on, any of %v", tokenrefresher.TriggerNames()))
+	rootCmd.PersistentFlags().String("trigger_policy", tokenrefresher.TriggerPolicyAny, "start refreshing when any or all of the triggers fired")
+	rootCmd.PersistentFlags().String("trigger_file", "", "path watched by the file trigger, defaults to the shutdown file")
+	rootCmd.PersistentFlags().String("trigger_http_addr", "", "loopback address, e.g. localhost:8081, or unix:<path> of a socket to serve the http trigger on, fires on POST /trigger")
+	rootCmd.PersistentFlags().String("trigger_schedule", "", "RFC3339 time or cron expression the schedule trigger fires at")
+	rootCmd.PersistentFlags().Bool("watch_pod", false, "enable the pod_deletion trigger, which starts refreshing as soon as the pod is marked for deletion, needs pod_name and get and watch on pods")
+	rootCmd.PersistentFlags().String("heartbeat_file", "", "file the app touches regularly, tokens are not refreshed anymore once it is older than heartbeat_window")
+	rootCmd.PersistentFlags().String("heartbeat_addr", "", "loopback address, e.g. localhost:8082, or unix:<path> of a socket to serve POST /heartbeat on for the app to call regularly")
+	rootCmd.PersistentFlags().Duration("heartbeat_window", tokenrefresher.DefaultHeartbeatWindow, "how long the app's heartbeat may be stale before tokens are not refreshed anymore")
+	rootCmd.PersistentFlags().String("app_pattern", "", "regular expression matching the command line of the app, refreshing stops once it has exited, needs a shared process namespace")
+	rootCmd.PersistentFlags().String("app_pid_file", "", "pid file of the app, refreshing stops once it has exited, needs a shared process namespace")
+	rootCmd.PersistentFlags().StringSlice("primary_containers", nil, "comma separated containers of the pod, refreshing stops once all of them have terminated, needs pod_name and get and watch on pods")
+	rootCmd.PersistentFlags().Bool("termination_deadline", false, "cut refreshed tokens to the pod's termination deadline and stop refreshing once it has passed, needs pod_name and get on pods")
+	rootCmd.PersistentFlags().String("admin_addr", "", "loopback address, e.g. localhost:8083, or unix:<path> of a socket to serve the admin API on: POST /refresh, /trigger and /stop, GET /status")
+	rootCmd.PersistentFlags().Bool("admin_pprof", false, "serve pprof under /debug/pprof/ on the admin API")
+	rootCmd.PersistentFlags().String("source", tokenrefresher.SourceTokenRequest, "where refreshed tokens come from: token_request, file, exec or http")
+	rootCmd.PersistentFlags().String("source_file", "", "token file read by the file source, e.g. another projected token")
+	rootCmd.PersistentFlags().String("source_command", "", "command run in a shell by the exec source which prints the token on stdout, gets TOKEN_REFRESHER_AUDIENCES and TOKEN_REFRESHER_EXPIRATION_SECONDS")
+	rootCmd.PersistentFlags().String("source_url", "", "url of the http source, called with ?audience=&expiration_seconds= and returning the token as is or as json with a token field")
+	rootCmd.PersistentFlags().Duration("source_timeout", tokenrefresher.DefaultSourceTimeout, "timeout of a single attempt to get a token from the source")
+	rootCmd.PersistentFlags().String("sts_role_arn", "", "role assumed by the sts sink with the refreshed token, defaults to AWS_ROLE_ARN")
+	rootCmd.PersistentFlags().String("sts_session_name", "", "session name of the assumed role, defaults to AWS_ROLE_SESSION_NAME, else token-refresher")
+	rootCmd.PersistentFlags().String("sts_endpoint", "", "STS endpoint, defaults to AWS_ENDPOINT_URL_STS, else the regional endpoint of AWS_REGION, else https://sts.amazonaws.com")
+	rootCmd.PersistentFlags().Duration("sts_duration", 0, "session duration of the assumed role, the role's default if unset")
+	rootCmd.PersistentFlags().String("sts_credentials_file", "", "shared credentials file the sts sink writes once refreshing has started, defaults to credentials in the directory of token_file")
+	rootCmd.PersistentFlags().String("sts_profile", tokenrefresher.DefaultSTSProfile, "profile of the credentials in sts_credentials_file")
+	rootCmd.PersistentFlags().Duration("sts_refresh_before", tokenrefresher.DefaultSTSRefreshBefore, "how long before their expiry the credentials are renewed with the latest token")
+	rootCmd.PersistentFlags().String("token_api_addr", "", "unix:<path> of a socket to serve the current token on: GET /token?audience= and GET /token/watch, or a loopback address, e.g. localhost:8084, with token_api_allow_tcp")
+	rootCmd.PersistentFlags().Bool("token_api_allow_tcp", false, "allow a loopback token_api_addr, which serves the token to every process in the pod without checking its uid")
+	rootCmd.PersistentFlags().StringSlice("token_api_audiences", nil, "comma separated audiences the token API socket mints tokens for on demand besides --token_audience")
+	rootCmd.PersistentFlags().IntSlice("token_api_uids", nil, "comma separated uids allowed to connect to the token API socket, defaults to the refresher's own")
+	rootCmd.PersistentFlags().String("hook_command", "", "shell command to run after every refresh, gets TOKEN_REFRESHER_TOKEN_FILE and TOKEN_REFRESHER_EXPIRES_AT in its env")
+	rootCmd.PersistentFlags().String("hook_url", "", "url to POST to after every refresh")
+	rootCmd.PersistentFlags().String("hook_signal", "", "signal to send to a process after every refresh, e.g. SIGHUP")
+	rootCmd.PersistentFlags().String("hook_process_name", "", "name of the process to signal, needs a shared process namespace")
+	rootCmd.PersistentFlags().String("hook_pid_file", "", "pid file of the process to signal")
+	rootCmd.PersistentFlags().Duration("hook_timeout", tokenrefresher.DefaultHookTimeout, "timeout of a single hook attempt")
+	rootCmd.PersistentFlags().Int("hook_max_attempts", tokenrefresher.DefaultHookMaxAttempts, "max attempts per hook")
+	rootCmd.PersistentFlags().Duration("hook_sleep", tokenrefresher.DefaultHookSleep, "sleep duration between hook retries")
 
 	if home := homedir.HomeDir(); home != "" {
-		rootCmd.Flags().String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+		rootCmd.PersistentFlags().String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
 	} else {
-		rootCmd.Flags().String("kubeconfig", "", "absolute path to the kubeconfig file")
+		rootCmd.PersistentFlags().String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
 
-	viper.BindPFlags(rootCmd.LocalFlags())
-}
-
-func initConfig() {
-	viper.AutomaticEnv() // read in upper-cased env vars corresponding to above CLI flags
-	conf = new(config)
-	err := viper.Unmarshal(conf)
-	if err != nil {
-		fmt.Printf("unable to decode into config struct, %v", err)
-	}
+	viper.BindPFlags(rootCmd.PersistentFlags())
 }
@@ -0,0 +1,356 @@
+// Package client provides the tokens refreshed by token-refresher to Go applications.
+// It follows the token file, or the local token API, so that applications always use the latest token
+// without re-implementing file rotation.
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultTokenFile is the default token file of token-refresher
+	DefaultTokenFile = "/var/run/secrets/token-refresher/token"
+	// DefaultMinValidity is how long a token must at least be valid to be returned, unless configured otherwise
+	DefaultMinValidity = time.Minute
+
+	unixPrefix = "unix:"
+	// clockSkew is tolerated on the issued at claim
+	clockSkew = time.Minute
+)
+
+// Token is a service account token along with its decoded claims
+type Token struct {
+	Value     string
+	Expiry    time.Time
+	IssuedAt  time.Time
+	Audiences []string
+	// Projected is set for a token projected by the kubelet, which is bound to the pod, as opposed to one
+	// refreshed by token-refresher. While the refresher is passive, its token file links to the projected token.
+	Projected bool
+}
+
+// Option configures a Source
+type Option func(*Source)
+
+// WithFile follows the given token file, DefaultTokenFile by default
+func WithFile(file string) Option {
+	return func(s *Source) {
+		s.file = file
+	}
+}
+
+// WithTokenAPI fetches tokens from the token API at the given address instead of reading the token file:
+// a loopback host:port or unix:<path> of a socket
+func WithTokenAPI(addr string) Option {
+	return func(s *Source) {
+		s.apiAddr = addr
+	}
+}
+
+// WithAudience only returns tokens for the given audience. With the token API, tokens for it are requested.
+func WithAudience(audience string) Option {
+	return func(s *Source) {
+		s.audience = audience
+	}
+}
+
+// WithMinValidity sets how long a token must at least be valid to be returned
+func WithMinValidity(d time.Duration) Option {
+	return func(s *Source) {
+		s.minValidity = d
+	}
+}
+
+// WithHTTPClient sets the client used for the token API of a loopback address
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Source) {
+		s.httpClient = c
+	}
+}
+
+// Source returns the latest valid token. It is safe for concurrent use.
+//
+// It implements oauth2.TokenSource, and with GetIdentityToken it can be used as the
+// stscreds.IdentityTokenRetriever of the AWS SDK v2.
+type Source struct {
+	file        string
+	apiAddr     string
+	audience    string
+	minValidity time.Duration
+	httpClient  *http.Client
+	now         func() time.Time
+
+	mu      sync.Mutex
+	current *Token
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New returns a Source following the token file or the token API. It stops following once Close is called.
+func New(opts ...Option) (*Source, error) {
+	s := &Source{
+		file:        DefaultTokenFile,
+		minValidity: DefaultMinValidity,
+		now:         time.Now,
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	if s.apiAddr != "" {
+		if s.httpClient == nil {
+			s.httpClient = apiClient(s.apiAddr)
+		}
+		go s.watchAPI(ctx)
+		return s, nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("unable to watch token file: %w", err)
+	}
+	// the directory is watched, as the file is replaced by renaming rather than written in place
+	if err := w.Add(filepath.Dir(s.file)); err != nil {
+		w.Close()
+		cancel()
+		return nil, fmt.Errorf("unable to watch token file %s: %w", s.file, err)
+	}
+	s.update(s.readFile())
+	go s.watchFile(ctx, w)
+	return s, nil
+}
+
+// Close stops following the token
+func (s *Source) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Current returns the latest token which is valid for at least the minimum validity
+func (s *Source) Current() (*Token, error) {
+	s.mu.Lock()
+	t := s.current
+	s.mu.Unlock()
+	if t != nil && s.valid(t) == nil {
+		return t, nil
+	}
+	// the cached token might not have been replaced yet, e.g. if the file links to a projected token
+	// whose rotation is not seen by the watch
+	var err error
+	if s.apiAddr != "" {
+		t, err = s.fetch(context.Background(), "/token")
+	} else {
+		t, err = s.readFile()
+	}
+	if err == nil {
+		err = s.valid(t)
+	}
+	s.update(t, err)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Token implements oauth2.TokenSource
+func (s *Source) Token() (*oauth2.Token, error) {
+	t, err := s.Current()
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: t.Value, TokenType: "Bearer", Expiry: t.Expiry}, nil
+}
+
+// GetIdentityToken implements stscreds.IdentityTokenRetriever of the AWS SDK v2
+func (s *Source) GetIdentityToken() ([]byte, error) {
+	t, err := s.Current()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(t.Value), nil
+}
+
+// update caches a token unless it is invalid
+func (s *Source) update(t *Token, err error) {
+	if err != nil || s.valid(t) != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = t
+}
+
+// valid returns an error if the token must not be used
+func (s *Source) valid(t *Token) error {
+	now := s.now()
+	if left := t.Expiry.Sub(now); left < s.minValidity {
+		return fmt.Errorf("token expires in %v, less than %v", left.Truncate(time.Second), s.minValidity)
+	}
+	if t.IssuedAt.After(now.Add(clockSkew)) {
+		return fmt.Errorf("token is issued in the future at %s", t.IssuedAt.Format(time.RFC3339))
+	}
+	if s.audience != "" && !slices.Contains(t.Audiences, s.audience) {
+		return fmt.Errorf("token is not for audience %s but %v", s.audience, t.Audiences)
+	}
+	return nil
+}
+
+func (s *Source) readFile() (*Token, error) {
+	b, err := os.ReadFile(s.file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token file: %w", err)
+	}
+	return Parse(strings.TrimSpace(string(b)))
+}
+
+func (s *Source) watchFile(ctx context.Context, w *fsnotify.Watcher) {
+	defer close(s.done)
+	defer w.Close()
+	for {
+		select {
+		case <-w.Events:
+			// any change in the directory may replace the file, e.g. the ..data link of a projected volume
+			s.update(s.readFile())
+		case <-w.Errors:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchAPI long-polls the token API for new tokens. Tokens for other audiences cannot be watched,
+// they are fetched by Current once the cached one is close to expiry.
+func (s *Source) watchAPI(ctx context.Context) {
+	defer close(s.done)
+	if s.audience != "" {
+		return
+	}
+	for ctx.Err() == nil {
+		t, err := s.fetch(ctx, "/token/watch")
+		if err != nil {
+			if !errors.Is(err, errNoNewToken) {
+				// back off, the refresher might be restarting
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+				}
+			}
+			continue
+		}
+		s.update(t, nil)
+	}
+}
+
+var errNoNewToken = errors.New("no new token")
+
+// fetch gets a token from the token API
+func (s *Source) fetch(ctx context.Context, path string) (*Token, error) {
+	u := url.URL{Scheme: "http", Host: s.apiAddr, Path: path}
+	if strings.HasPrefix(s.apiAddr, unixPrefix) {
+		u.Host = "token-refresher"
+	}
+	if s.audience != "" && path == "/token" {
+		u.RawQuery = url.Values{"audience": {s.audience}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, errNoNewToken
+	default:
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unable to get token: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("unable to decode token response: %w", err)
+	}
+	return Parse(body.Token)
+}
+
+// apiClient returns a client which connects to the socket of a unix: address
+func apiClient(addr string) *http.Client {
+	socket, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return &http.Client{}
+	}
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+// Parse decodes a service account token without verifying its signature, which is left to its audience
+func Parse(value string) (*Token, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode token: %w", err)
+	}
+	var claims struct {
+		Exp        *float64        `json:"exp"`
+		Iat        float64         `json:"iat"`
+		Aud        json.RawMessage `json:"aud"`
+		Kubernetes struct {
+			Pod *struct {
+				Name string `json:"name"`
+			} `json:"pod"`
+		} `json:"kubernetes.io"`
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("unable to decode claims: %w", err)
+	}
+	if claims.Exp == nil {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	t := &Token{
+		Value:     value,
+		Expiry:    time.Unix(int64(*claims.Exp), 0),
+		IssuedAt:  time.Unix(int64(claims.Iat), 0),
+		Projected: claims.Kubernetes.Pod != nil,
+	}
+	// aud is either a single string or a list of them
+	if len(claims.Aud) > 0 {
+		var aud string
+		if err := json.Unmarshal(claims.Aud, &aud); err == nil {
+			t.Audiences = []string{aud}
+		} else if err := json.Unmarshal(claims.Aud, &t.Audiences); err != nil {
+			return nil, fmt.Errorf("unable to decode audience: %w", err)
+		}
+	}
+	return t, nil
+}
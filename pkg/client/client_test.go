@@ -0,0 +1,182 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeToken(expiry time.Duration, projected bool, aud ...string) string {
+	claims := map[string]interface{}{
+		"exp": time.Now().Add(expiry).Unix(),
+		"iat": time.Now().Unix(),
+		"aud": aud,
+		"sub": "system:serviceaccount:test-ns:test-sa",
+	}
+	if projected {
+		claims["kubernetes.io"] = map[string]interface{}{"pod": map[string]string{"name": "test-pod"}}
+	}
+	b, _ := json.Marshal(claims)
+	return "e30." + base64.RawURLEncoding.EncodeToString(b) + ".sig"
+}
+
+// writeToken replaces the token file by renaming, as token-refresher does
+func writeToken(t *testing.T, file, token string) {
+	t.Helper()
+	if err := os.WriteFile(file+".tmp", []byte(token), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tok, err := Parse(makeToken(time.Hour, true, "sts.amazonaws.com"))
+	if err != nil {
+		t.Fatalf("Parse() failed: %s", err.Error())
+	}
+	if !tok.Projected || len(tok.Audiences) != 1 || tok.Audiences[0] != "sts.amazonaws.com" {
+		t.Errorf("unexpected token %+v", tok)
+	}
+	if tok, _ := Parse(makeToken(time.Hour, false)); tok.Projected {
+		t.Errorf("refreshed token parsed as projected")
+	}
+	single := "e30." + base64.RawURLEncoding.EncodeToString([]byte(`{"exp":1,"aud":"vault"}`)) + ".sig"
+	if tok, err := Parse(single); err != nil || len(tok.Audiences) != 1 || tok.Audiences[0] != "vault" {
+		t.Errorf("single audience not parsed: %v, %v", tok, err)
+	}
+	for _, invalid := range []string{"", "a.b", "e30.!!!.sig", "e30." + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".sig"} {
+		if _, err := Parse(invalid); err == nil {
+			t.Errorf("Parse(%q) did not fail", invalid)
+		}
+	}
+}
+
+func TestSource_file(t *testing.T) {
+	t.Run("Source should follow the token file", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "token")
+		first := makeToken(time.Hour, true)
+		writeToken(t, file, first)
+		s, err := New(WithFile(file))
+		if err != nil {
+			t.Fatalf("New() failed: %s", err.Error())
+		}
+		defer s.Close()
+
+		tok, err := s.Current()
+		if err != nil || tok.Value != first || !tok.Projected {
+			t.Fatalf("want the projected token, got %v, %v", tok, err)
+		}
+		second := makeToken(2*time.Hour, false)
+		writeToken(t, file, second)
+		deadline := time.Now().Add(time.Second)
+		for {
+			s.mu.Lock()
+			cur := s.current
+			s.mu.Unlock()
+			if cur.Value == second {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Source did not pick up the refreshed token")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		o, err := s.Token()
+		if err != nil || o.AccessToken != second || o.Expiry.Before(time.Now().Add(time.Hour)) {
+			t.Errorf("unexpected oauth2 token %v, %v", o, err)
+		}
+	})
+
+	t.Run("Source should never return an invalid token", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "token")
+		writeToken(t, file, makeToken(30*time.Second, false))
+		s, err := New(WithFile(file))
+		if err != nil {
+			t.Fatalf("New() failed: %s", err.Error())
+		}
+		defer s.Close()
+
+		if _, err := s.GetIdentityToken(); err == nil {
+			t.Errorf("GetIdentityToken() returned a token expiring within the min validity")
+		}
+		writeToken(t, file, makeToken(time.Hour, false, "vault"))
+		if tok, err := s.GetIdentityToken(); err != nil || len(tok) == 0 {
+			t.Errorf("GetIdentityToken() failed on a valid token: %v", err)
+		}
+
+		s2, err := New(WithFile(file), WithAudience("sts.amazonaws.com"))
+		if err != nil {
+			t.Fatalf("New() failed: %s", err.Error())
+		}
+		defer s2.Close()
+		if _, err := s2.Current(); err == nil || !strings.Contains(err.Error(), "audience") {
+			t.Errorf("Current() returned a token for another audience: %v", err)
+		}
+	})
+}
+
+func TestSource_tokenAPI(t *testing.T) {
+	refreshed := make(chan string, 1)
+	current := makeToken(time.Hour, false)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := current
+		switch req.URL.Path {
+		case "/token":
+			if aud := req.URL.Query().Get("audience"); aud != "" {
+				token = makeToken(time.Hour, false, aud)
+			}
+		case "/token/watch":
+			select {
+			case token = <-refreshed:
+			case <-time.After(50 * time.Millisecond):
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	s, err := New(WithTokenAPI(addr))
+	if err != nil {
+		t.Fatalf("New() failed: %s", err.Error())
+	}
+	if tok, err := s.Current(); err != nil || tok.Value != current {
+		t.Fatalf("want the current token, got %v, %v", tok, err)
+	}
+	next := makeToken(2*time.Hour, false)
+	refreshed <- next
+	deadline := time.Now().Add(time.Second)
+	for {
+		tok, err := s.Current()
+		if err != nil {
+			t.Fatalf("Current() failed: %s", err.Error())
+		}
+		if tok.Value == next {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Source did not pick up the watched token")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+
+	s, err = New(WithTokenAPI(addr), WithAudience("vault"))
+	if err != nil {
+		t.Fatalf("New() failed: %s", err.Error())
+	}
+	defer s.Close()
+	if tok, err := s.Current(); err != nil || len(tok.Audiences) != 1 || tok.Audiences[0] != "vault" {
+		t.Errorf("want a token for vault, got %v, %v", tok, err)
+	}
+}
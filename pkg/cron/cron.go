@@ -0,0 +1,161 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed standard cron expression: minute, hour, day of month, month and day of week
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are set if the field starts with a star, which changes how the day fields combine
+	domStar, dowStar bool
+}
+
+type bounds struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dows = bounds{0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a 5-field cron expression such as "*/15 9-17 * * mon-fri" or one of the @daily style macros
+func Parse(spec string) (*Schedule, error) {
+	if m, ok := macros[strings.TrimSpace(spec)]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", spec, len(fields))
+	}
+	s := &Schedule{}
+	var err error
+	if s.minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, fmt.Errorf("invalid minute: %w", err)
+	}
+	if s.hour, err = parseField(fields[1], hours); err != nil {
+		return nil, fmt.Errorf("invalid hour: %w", err)
+	}
+	if s.dom, err = parseField(fields[2], doms); err != nil {
+		return nil, fmt.Errorf("invalid day of month: %w", err)
+	}
+	if s.month, err = parseField(fields[3], months); err != nil {
+		return nil, fmt.Errorf("invalid month: %w", err)
+	}
+	if s.dow, err = parseField(fields[4], dows); err != nil {
+		return nil, fmt.Errorf("invalid day of week: %w", err)
+	}
+	// 7 is an alias for sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	// like in Vixie cron, a day field starting with a star, e.g. */2, counts as unrestricted
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseField parses a comma separated list of values, ranges and steps into a bitset
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := uint(1)
+		if hasStep {
+			n, err := strconv.ParseUint(stepStr, 10, 8)
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = uint(n)
+		}
+		lo, hi := b.min, b.max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = parseValue(loStr, b); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseValue(hiStr, b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = b.max
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, b bounds) (uint, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || uint(n) < b.min || uint(n) > b.max {
+		return 0, fmt.Errorf("value %q must be between %d and %d", s, b.min, b.max)
+	}
+	return uint(n), nil
+}
+
+// Next returns the first time after t matching the schedule, or the zero time if there is none within 5 years
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			// Truncate works in absolute time, which is off in zones with a half hour offset
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches combines the day fields like cron does: if both are restricted, either may match
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
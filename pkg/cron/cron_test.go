@@ -0,0 +1,59 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule_Next(t *testing.T) {
+	from := time.Date(2024, time.March, 15, 10, 7, 30, 0, time.UTC) // a friday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.March, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.March, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 9-17 * * mon-fri", time.Date(2024, time.March, 15, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * sun", time.Date(2024, time.March, 17, 2, 30, 0, 0, time.UTC)},
+		{"30 2 * * 7", time.Date(2024, time.March, 17, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, time.March, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * fri", time.Date(2024, time.March, 22, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */2 * fri", time.Date(2024, time.March, 29, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatalf("Parse() failed: %s", err.Error())
+			}
+			if got := s.Next(from); !got.Equal(tt.want) {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSchedule_Next_halfHourOffset(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+1800)
+	s, err := Parse("0 3 * * *")
+	if err != nil {
+		t.Fatalf("Parse() failed: %s", err.Error())
+	}
+	from := time.Date(2024, time.March, 15, 1, 10, 0, 0, ist)
+	if got, want := s.Next(from), time.Date(2024, time.March, 15, 3, 0, 0, 0, ist); !got.Equal(want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		t.Run(spec, func(t *testing.T) {
+			if _, err := Parse(spec); err == nil {
+				t.Errorf("Parse() did not fail on %q", spec)
+			}
+		})
+	}
+}
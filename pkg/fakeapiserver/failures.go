@@ -0,0 +1,104 @@
+package fakeapiserver
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failure is how the server misbehaves on the requests it matches
+type Failure struct {
+	// Path restricts the failure to requests whose path ends with it, e.g. "/token" for the TokenRequest API, all requests if empty
+	Path string
+	// Times is how many matching requests fail, 1 if unset
+	Times int
+	// Delay holds the response back. The request is served normally afterwards unless it fails otherwise.
+	Delay time.Duration
+	// Reset closes the connection without a response
+	Reset bool
+	// Status responds with a Status error of the given code, e.g. http.StatusTooManyRequests
+	Status int
+	// RetryAfter is sent along with Status, rounded up to whole seconds
+	RetryAfter time.Duration
+}
+
+// Fail schedules failures. Every request is matched against the scheduled failures in order
+// and fails according to the first one matching it, until it has been used up.
+func (s *Server) Fail(failures ...Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range failures {
+		if f.Times <= 0 {
+			f.Times = 1
+		}
+		s.failures = append(s.failures, f)
+	}
+}
+
+// Pending returns how many scheduled failures have not been used up yet
+func (s *Server) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, f := range s.failures {
+		n += f.Times
+	}
+	return n
+}
+
+// nextFailure takes the first scheduled failure matching the request, if any
+func (s *Server) nextFailure(req *http.Request) (Failure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.failures {
+		if !strings.HasSuffix(req.URL.Path, f.Path) {
+			continue
+		}
+		if s.failures[i].Times--; s.failures[i].Times == 0 {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+		}
+		return f, true
+	}
+	return Failure{}, false
+}
+
+// fail applies the failure and returns true if the request has been dealt with
+func (s *Server) fail(w http.ResponseWriter, req *http.Request, f Failure) bool {
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-req.Context().Done():
+			return true
+		}
+	}
+	if f.Reset {
+		reset(w)
+		return true
+	}
+	if f.Status != 0 {
+		if f.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((f.RetryAfter+time.Second-1)/time.Second)))
+		}
+		writeStatus(w, f.Status, "injected failure")
+		return true
+	}
+	return false
+}
+
+// reset closes the connection of the request, with a TCP reset if possible
+func reset(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,400 @@
+// Package fakeapiserver runs a fake Kubernetes API server for tests, which mints and verifies service account
+// tokens signed with a real key. It serves the TokenRequest, TokenReview and SelfSubjectAccessReview APIs
+// along with OIDC discovery, and can be scripted to fail like a real API server does under load:
+// slow responses, connection resets, throttling with Retry-After and expiration capping.
+// Other resources are not served.
+package fakeapiserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// DefaultExpiration is used for token requests without an expiration
+	DefaultExpiration = time.Hour
+	// MinExpiration is the shortest expiration the API server accepts
+	MinExpiration = 10 * time.Minute
+
+	jwksPath = "/openid/v1/jwks"
+)
+
+// Authorizer decides on SelfSubjectAccessReviews
+type Authorizer func(attrs authzv1.ResourceAttributes) bool
+
+// Request is a request received by the server
+type Request struct {
+	Method string
+	Path   string
+	// Status of the response, 0 if the connection was reset or the response is still being written
+	Status int
+}
+
+// Server is a fake API server listening on a local port
+type Server struct {
+	// URL of the server, also the issuer of its tokens unless configured otherwise
+	URL string
+
+	t             testing.TB
+	srv           *httptest.Server
+	mux           *http.ServeMux
+	signer        *signer
+	issuer        string
+	audiences     []string
+	maxExpiration time.Duration
+	now           func() time.Time
+	authorize     Authorizer
+
+	mu       sync.Mutex
+	failures []Failure
+	requests []Request
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithIssuer sets the iss claim of minted tokens, the URL of the server by default
+func WithIssuer(issuer string) Option {
+	return func(s *Server) {
+		s.issuer = issuer
+	}
+}
+
+// WithAudiences sets the audiences of tokens requested without any, the issuer by default
+func WithAudiences(audiences ...string) Option {
+	return func(s *Server) {
+		s.audiences = audiences
+	}
+}
+
+// WithMaxExpiration caps the expiration of minted tokens, like --service-account-max-token-expiration
+func WithMaxExpiration(d time.Duration) Option {
+	return func(s *Server) {
+		s.maxExpiration = d
+	}
+}
+
+// WithClock sets the time tokens are issued and verified at, the system time by default
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// WithAuthorizer decides on SelfSubjectAccessReviews, which are all allowed by default
+func WithAuthorizer(a Authorizer) Option {
+	return func(s *Server) {
+		s.authorize = a
+	}
+}
+
+// New starts a server which is closed at the end of the test
+func New(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+	sig, err := newSigner()
+	if err != nil {
+		t.Fatalf("unable to create signer: %s", err.Error())
+	}
+	s := &Server{t: t, mux: http.NewServeMux(), signer: sig, now: time.Now}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.HandleFunc("POST /api/v1/namespaces/{namespace}/serviceaccounts/{name}/token", s.createToken)
+	s.mux.HandleFunc("POST /apis/authentication.k8s.io/v1/tokenreviews", s.reviewToken)
+	s.mux.HandleFunc("POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews", s.reviewAccess)
+	s.mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	s.mux.HandleFunc("GET "+jwksPath, s.keys)
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("the server could not find the requested resource %s", req.URL.Path))
+	})
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.srv.URL
+	if s.issuer == "" {
+		s.issuer = s.URL
+	}
+	if len(s.audiences) == 0 {
+		s.audiences = []string{s.issuer}
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Config returns a client config for the server
+func (s *Server) Config() *rest.Config {
+	return &rest.Config{Host: s.URL, QPS: 1000, Burst: 1000}
+}
+
+// Client returns a client of the server
+func (s *Server) Client() kubernetes.Interface {
+	s.t.Helper()
+	client, err := kubernetes.NewForConfig(s.Config())
+	if err != nil {
+		s.t.Fatalf("unable to create client: %s", err.Error())
+	}
+	return client
+}
+
+// Issuer returns the iss claim of minted tokens
+func (s *Server) Issuer() string {
+	return s.issuer
+}
+
+// Requests returns the requests received so far, including failed ones
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// Mint returns a token of the service account, e.g. to write the projected token of a test
+func (s *Server) Mint(ns, sa string, audiences []string, expiration time.Duration) string {
+	s.t.Helper()
+	token, err := s.signer.sign(s.claims(ns, sa, audiences, expiration))
+	if err != nil {
+		s.t.Fatalf("unable to mint token: %s", err.Error())
+	}
+	return token
+}
+
+// Verify checks that the token was minted by the server and has not expired, and returns its claims
+func (s *Server) Verify(token string) (Claims, error) {
+	claims, err := s.signer.verify(token)
+	if err != nil {
+		return claims, err
+	}
+	now := s.now()
+	if now.Unix() >= claims.Expiry {
+		return claims, fmt.Errorf("token has expired at %s", claims.ExpiresAt().Format(time.RFC3339))
+	}
+	if now.Unix() < claims.NotBefore {
+		return claims, fmt.Errorf("token is not valid before %s", time.Unix(claims.NotBefore, 0).Format(time.RFC3339))
+	}
+	return claims, nil
+}
+
+func (s *Server) claims(ns, sa string, audiences []string, expiration time.Duration) Claims {
+	if len(audiences) == 0 {
+		audiences = s.audiences
+	}
+	now := s.now()
+	return Claims{
+		Issuer:    s.issuer,
+		Subject:   fmt.Sprintf("system:serviceaccount:%s:%s", ns, sa),
+		Audiences: audiences,
+		Expiry:    now.Add(expiration).Unix(),
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Kubernetes: KubernetesClaims{
+			Namespace:      ns,
+			ServiceAccount: ObjectRef{Name: sa, UID: serviceAccountUID(ns, sa)},
+		},
+	}
+}
+
+// serviceAccountUID returns a stable uid, as service accounts are not stored
+func serviceAccountUID(ns, sa string) string {
+	return fmt.Sprintf("fake-uid-%s-%s", ns, sa)
+}
+
+func (s *Server) serve(w http.ResponseWriter, req *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w}
+	s.mu.Lock()
+	i := len(s.requests)
+	s.requests = append(s.requests, Request{Method: req.Method, Path: req.URL.Path})
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests[i].Status = rec.status
+	}()
+	if f, ok := s.nextFailure(req); ok && s.fail(rec, req, f) {
+		return
+	}
+	s.mux.ServeHTTP(rec, req)
+}
+
+func (s *Server) createToken(w http.ResponseWriter, req *http.Request) {
+	ns, sa := req.PathValue("namespace"), req.PathValue("name")
+	var tr authv1.TokenRequest
+	if err := json.NewDecoder(req.Body).Decode(&tr); err != nil {
+		writeStatus(w, http.StatusBadRequest, fmt.Sprintf("unable to decode token request: %s", err.Error()))
+		return
+	}
+	expSec := int64(DefaultExpiration.Seconds())
+	if tr.Spec.ExpirationSeconds != nil {
+		expSec = *tr.Spec.ExpirationSeconds
+	}
+	if expSec < int64(MinExpiration.Seconds()) {
+		writeStatus(w, http.StatusBadRequest, "spec.expirationSeconds: Invalid value: may not specify a duration less than 10 minutes")
+		return
+	}
+	if s.maxExpiration > 0 && expSec > int64(s.maxExpiration.Seconds()) {
+		expSec = int64(s.maxExpiration.Seconds())
+	}
+	claims := s.claims(ns, sa, tr.Spec.Audiences, time.Duration(expSec)*time.Second)
+	if ref := tr.Spec.BoundObjectRef; ref != nil && ref.Kind == "Pod" {
+		claims.Kubernetes.Pod = &ObjectRef{Name: ref.Name, UID: string(ref.UID)}
+	}
+	token, err := s.signer.sign(claims)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tr.TypeMeta = metav1.TypeMeta{Kind: "TokenRequest", APIVersion: "authentication.k8s.io/v1"}
+	tr.ObjectMeta = metav1.ObjectMeta{Name: sa, Namespace: ns, CreationTimestamp: metav1.NewTime(s.now())}
+	tr.Spec.Audiences = claims.Audiences
+	tr.Spec.ExpirationSeconds = &expSec
+	tr.Status = authv1.TokenRequestStatus{Token: token, ExpirationTimestamp: metav1.NewTime(claims.ExpiresAt())}
+	writeJSON(w, http.StatusCreated, tr)
+}
+
+func (s *Server) reviewToken(w http.ResponseWriter, req *http.Request) {
+	var review authv1.TokenReview
+	if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+		writeStatus(w, http.StatusBadRequest, fmt.Sprintf("unable to decode token review: %s", err.Error()))
+		return
+	}
+	review.TypeMeta = metav1.TypeMeta{Kind: "TokenReview", APIVersion: "authentication.k8s.io/v1"}
+	audiences := review.Spec.Audiences
+	if len(audiences) == 0 {
+		audiences = s.audiences
+	}
+	claims, err := s.Verify(review.Spec.Token)
+	if err == nil && !intersects(claims.Audiences, audiences) {
+		err = fmt.Errorf("token audiences %v is invalid for the target audiences %v", claims.Audiences, audiences)
+	}
+	if err != nil {
+		review.Status = authv1.TokenReviewStatus{Error: err.Error()}
+		writeJSON(w, http.StatusCreated, review)
+		return
+	}
+	ns := claims.Kubernetes.Namespace
+	user := authv1.UserInfo{
+		Username: claims.Subject,
+		UID:      claims.Kubernetes.ServiceAccount.UID,
+		Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:" + ns, "system:authenticated"},
+	}
+	if pod := claims.Kubernetes.Pod; pod != nil {
+		user.Extra = map[string]authv1.ExtraValue{
+			"authentication.kubernetes.io/pod-name": {pod.Name},
+			"authentication.kubernetes.io/pod-uid":  {pod.UID},
+		}
+	}
+	var matched []string
+	for _, aud := range audiences {
+		if slices.Contains(claims.Audiences, aud) {
+			matched = append(matched, aud)
+		}
+	}
+	review.Status = authv1.TokenReviewStatus{Authenticated: true, User: user, Audiences: matched}
+	writeJSON(w, http.StatusCreated, review)
+}
+
+func (s *Server) reviewAccess(w http.ResponseWriter, req *http.Request) {
+	var review authzv1.SelfSubjectAccessReview
+	if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+		writeStatus(w, http.StatusBadRequest, fmt.Sprintf("unable to decode access review: %s", err.Error()))
+		return
+	}
+	review.TypeMeta = metav1.TypeMeta{Kind: "SelfSubjectAccessReview", APIVersion: "authorization.k8s.io/v1"}
+	allowed := s.authorize == nil
+	if attrs := review.Spec.ResourceAttributes; attrs != nil && s.authorize != nil {
+		allowed = s.authorize(*attrs)
+	}
+	review.Status = authzv1.SubjectAccessReviewStatus{Allowed: allowed}
+	if !allowed {
+		review.Status.Reason = "denied by the fake authorizer"
+	}
+	writeJSON(w, http.StatusCreated, review)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.issuer,
+		"jwks_uri":                              s.URL + jwksPath,
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (s *Server) keys(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": s.signer.jwks()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeStatus responds with a Status error, as the API server does
+func writeStatus(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  msg,
+		Reason:   reasonFor(code),
+		Code:     int32(code),
+	})
+}
+
+func reasonFor(code int) metav1.StatusReason {
+	switch code {
+	case http.StatusBadRequest:
+		return metav1.StatusReasonBadRequest
+	case http.StatusUnauthorized:
+		return metav1.StatusReasonUnauthorized
+	case http.StatusForbidden:
+		return metav1.StatusReasonForbidden
+	case http.StatusNotFound:
+		return metav1.StatusReasonNotFound
+	case http.StatusConflict:
+		return metav1.StatusReasonConflict
+	case http.StatusTooManyRequests:
+		return metav1.StatusReasonTooManyRequests
+	case http.StatusServiceUnavailable:
+		return metav1.StatusReasonServiceUnavailable
+	case http.StatusGatewayTimeout:
+		return metav1.StatusReasonTimeout
+	}
+	return metav1.StatusReasonInternalError
+}
+
+// statusRecorder records the status of the response while keeping the connection hijackable
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	return hj.Hijack()
+}
@@ -0,0 +1,227 @@
+package fakeapiserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func createToken(ctx context.Context, c kubernetes.Interface, auds []string, exp time.Duration) (*authv1.TokenRequest, error) {
+	expSec := int64(exp.Seconds())
+	req := &authv1.TokenRequest{Spec: authv1.TokenRequestSpec{Audiences: auds, ExpirationSeconds: &expSec}}
+	return c.CoreV1().ServiceAccounts("test-ns").CreateToken(ctx, "test-sa", req, metav1.CreateOptions{})
+}
+
+func reviewToken(t *testing.T, c kubernetes.Interface, token string, auds []string) authv1.TokenReviewStatus {
+	t.Helper()
+	review := &authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: token, Audiences: auds}}
+	resp, err := c.AuthenticationV1().TokenReviews().Create(context.Background(), review, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("unable to review token: %s", err.Error())
+	}
+	return resp.Status
+}
+
+func TestServer_tokens(t *testing.T) {
+	t.Run("TokenRequest should mint tokens which pass a TokenReview", func(t *testing.T) {
+		s := New(t)
+		c := s.Client()
+
+		tr, err := createToken(context.Background(), c, []string{"vault"}, 2*time.Hour)
+		if err != nil {
+			t.Fatalf("unable to create token: %s", err.Error())
+		}
+		claims, err := s.Verify(tr.Status.Token)
+		if err != nil {
+			t.Fatalf("minted token does not verify: %s", err.Error())
+		}
+		if claims.Subject != "system:serviceaccount:test-ns:test-sa" || claims.Issuer != s.URL {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+		if d := time.Until(claims.ExpiresAt()); d < 2*time.Hour-time.Minute || d > 2*time.Hour {
+			t.Errorf("want the token to expire in 2h, got %v", d)
+		}
+		status := reviewToken(t, c, tr.Status.Token, []string{"vault"})
+		if !status.Authenticated || status.User.Username != claims.Subject {
+			t.Errorf("want the token authenticated as %s, got %+v", claims.Subject, status)
+		}
+		if status := reviewToken(t, c, tr.Status.Token, []string{"sts"}); status.Authenticated {
+			t.Errorf("want the token rejected for another audience")
+		}
+	})
+
+	t.Run("TokenReview should reject expired and foreign tokens", func(t *testing.T) {
+		now := time.Now()
+		s := New(t, WithClock(func() time.Time { return now }))
+		token := s.Mint("test-ns", "test-sa", nil, time.Hour)
+		now = now.Add(2 * time.Hour)
+
+		if status := reviewToken(t, s.Client(), token, nil); status.Authenticated || !strings.Contains(status.Error, "expired") {
+			t.Errorf("want the expired token rejected, got %+v", status)
+		}
+		other := New(t)
+		if status := reviewToken(t, other.Client(), token, nil); status.Authenticated {
+			t.Errorf("want a token of another server rejected")
+		}
+	})
+
+	t.Run("TokenRequest should cap and bound the expiration", func(t *testing.T) {
+		s := New(t, WithMaxExpiration(time.Hour))
+		c := s.Client()
+
+		tr, err := createToken(context.Background(), c, nil, 24*time.Hour)
+		if err != nil {
+			t.Fatalf("unable to create token: %s", err.Error())
+		}
+		if *tr.Spec.ExpirationSeconds != 3600 || time.Until(tr.Status.ExpirationTimestamp.Time) > time.Hour {
+			t.Errorf("want the expiration capped to 1h, got %ds", *tr.Spec.ExpirationSeconds)
+		}
+		if _, err := createToken(context.Background(), c, nil, 5*time.Minute); !apierrors.IsBadRequest(err) {
+			t.Errorf("want a bad request for an expiration below 10m, got %v", err)
+		}
+	})
+
+	t.Run("SelfSubjectAccessReview should follow the authorizer", func(t *testing.T) {
+		s := New(t, WithAuthorizer(func(attrs authzv1.ResourceAttributes) bool {
+			return attrs.Resource == "serviceaccounts" && attrs.Subresource == "token"
+		}))
+		c := s.Client()
+
+		for _, tt := range []struct {
+			attrs authzv1.ResourceAttributes
+			want  bool
+		}{
+			{attrs: authzv1.ResourceAttributes{Verb: "create", Resource: "serviceaccounts", Subresource: "token"}, want: true},
+			{attrs: authzv1.ResourceAttributes{Verb: "get", Resource: "secrets"}, want: false},
+		} {
+			review := &authzv1.SelfSubjectAccessReview{Spec: authzv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &tt.attrs}}
+			resp, err := c.AuthorizationV1().SelfSubjectAccessReviews().Create(context.Background(), review, metav1.CreateOptions{})
+			if err != nil {
+				t.Fatalf("unable to review access: %s", err.Error())
+			}
+			if resp.Status.Allowed != tt.want {
+				t.Errorf("%s %s: want allowed %v, got %v", tt.attrs.Verb, tt.attrs.Resource, tt.want, resp.Status.Allowed)
+			}
+		}
+	})
+}
+
+func TestServer_discovery(t *testing.T) {
+	s := New(t)
+	resp, err := http.Get(s.URL + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatalf("unable to get discovery document: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("unable to decode discovery document: %s", err.Error())
+	}
+	if doc.Issuer != s.Issuer() {
+		t.Errorf("want issuer %s, got %s", s.Issuer(), doc.Issuer)
+	}
+	resp, err = http.Get(doc.JWKSURI)
+	if err != nil {
+		t.Fatalf("unable to get keys: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	var keys struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		t.Fatalf("unable to decode keys: %s", err.Error())
+	}
+	if len(keys.Keys) != 1 || keys.Keys[0].KeyID != s.signer.keyID || keys.Keys[0].N == "" {
+		t.Errorf("want the signing key, got %+v", keys.Keys)
+	}
+}
+
+func TestServer_Fail(t *testing.T) {
+	t.Run("throttled requests should be retried after Retry-After", func(t *testing.T) {
+		s := New(t)
+		s.Fail(Failure{Path: "/token", Status: http.StatusTooManyRequests, RetryAfter: time.Second})
+		start := time.Now()
+
+		if _, err := createToken(context.Background(), s.Client(), nil, time.Hour); err != nil {
+			t.Fatalf("unable to create token: %s", err.Error())
+		}
+		if d := time.Since(start); d < time.Second {
+			t.Errorf("want the client to wait for Retry-After, took %v", d)
+		}
+		if reqs := s.Requests(); len(reqs) != 2 || reqs[0].Status != http.StatusTooManyRequests {
+			t.Errorf("want a throttled and a successful request, got %+v", reqs)
+		}
+	})
+
+	t.Run("sub-second Retry-After should be rounded up", func(t *testing.T) {
+		s := New(t)
+		s.Fail(Failure{Status: http.StatusTooManyRequests, RetryAfter: 100 * time.Millisecond})
+
+		resp, err := http.Get(s.URL + "/.well-known/openid-configuration")
+		if err != nil {
+			t.Fatalf("request failed: %s", err.Error())
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Retry-After"); got != "1" {
+			t.Errorf("want Retry-After 1, got %q", got)
+		}
+	})
+
+	t.Run("failures should only match the end of the path", func(t *testing.T) {
+		s := New(t)
+		s.Fail(Failure{Path: "/token", Status: http.StatusInternalServerError})
+		c := s.Client()
+
+		reviewToken(t, c, s.Mint("test-ns", "test-sa", nil, time.Hour), nil)
+		if s.Pending() != 1 {
+			t.Errorf("want the failure left for the TokenRequest API, %d pending", s.Pending())
+		}
+		if _, err := createToken(context.Background(), c, nil, time.Hour); !apierrors.IsInternalError(err) {
+			t.Errorf("want an internal error, got %v", err)
+		}
+	})
+
+	t.Run("failures should be used up in order", func(t *testing.T) {
+		s := New(t)
+		s.Fail(Failure{Path: "/token", Status: http.StatusInternalServerError, Times: 2}, Failure{Reset: true})
+		c := s.Client()
+
+		for i := 0; i < 2; i++ {
+			if _, err := createToken(context.Background(), c, nil, time.Hour); !apierrors.IsInternalError(err) {
+				t.Errorf("request %d: want an internal error, got %v", i, err)
+			}
+		}
+		if _, err := createToken(context.Background(), c, nil, time.Hour); err == nil || apierrors.ReasonForError(err) != metav1.StatusReasonUnknown {
+			t.Errorf("want a connection error, got %v", err)
+		}
+		if s.Pending() != 0 {
+			t.Errorf("want all failures used up, %d pending", s.Pending())
+		}
+		if _, err := createToken(context.Background(), c, nil, time.Hour); err != nil {
+			t.Errorf("want requests served again, got %s", err.Error())
+		}
+	})
+
+	t.Run("slow responses should time out", func(t *testing.T) {
+		s := New(t)
+		s.Fail(Failure{Delay: time.Second})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		if _, err := createToken(ctx, s.Client(), nil, time.Hour); err == nil {
+			t.Errorf("want the request to time out")
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package fakeapiserver
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Claims of the service account tokens minted by the server, as the API server sets them
+type Claims struct {
+	Issuer     string           `json:"iss"`
+	Subject    string           `json:"sub"`
+	Audiences  []string         `json:"aud"`
+	Expiry     int64            `json:"exp"`
+	IssuedAt   int64            `json:"iat"`
+	NotBefore  int64            `json:"nbf"`
+	Kubernetes KubernetesClaims `json:"kubernetes.io"`
+}
+
+// KubernetesClaims tell which service account, and pod if bound to one, the token belongs to
+type KubernetesClaims struct {
+	Namespace      string     `json:"namespace"`
+	ServiceAccount ObjectRef  `json:"serviceaccount"`
+	Pod            *ObjectRef `json:"pod,omitempty"`
+}
+
+// ObjectRef names an object in the claims
+type ObjectRef struct {
+	Name string `json:"name"`
+	UID  string `json:"uid"`
+}
+
+// ExpiresAt returns the time given by the exp claim
+func (c Claims) ExpiresAt() time.Time {
+	return time.Unix(c.Expiry, 0)
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// jwk is an RSA public key in the format of the JWKS endpoint
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// signer signs tokens with RS256, like the API server does with its service account key
+type signer struct {
+	key   *rsa.PrivateKey
+	keyID string
+}
+
+func newSigner() (*signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return &signer{key: key, keyID: base64.RawURLEncoding.EncodeToString(sum[:])}, nil
+}
+
+func (s *signer) sign(claims Claims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: "RS256", KeyID: s.keyID})
+	if err != nil {
+		return "", fmt.Errorf("unable to encode header: %w", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode claims: %w", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign token: %w", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verify checks the signature of the token and returns its claims. The expiry is left to the caller.
+func (s *signer) verify(token string) (Claims, error) {
+	var claims Claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("invalid token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, fmt.Errorf("unable to decode header: %w", err)
+	}
+	if header.Algorithm != "RS256" || header.KeyID != s.keyID {
+		return claims, fmt.Errorf("unknown key %s with algorithm %s", header.KeyID, header.Algorithm)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("unable to decode signature: %w", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&s.key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		return claims, fmt.Errorf("invalid signature: %w", err)
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("unable to decode claims: %w", err)
+	}
+	return claims, nil
+}
+
+func (s *signer) jwks() []jwk {
+	pub := s.key.PublicKey
+	return []jwk{{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: "RS256",
+		KeyID:     s.keyID,
+		N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// intersects tells whether any of the audiences is in both lists
+func intersects(a, b []string) bool {
+	for _, aud := range a {
+		if slices.Contains(b, aud) {
+			return true
+		}
+	}
+	return false
+}
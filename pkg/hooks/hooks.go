@@ -0,0 +1,183 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/process"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/retry"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/signals"
+)
+
+// Env vars passed on to the command hook
+const (
+	EnvTokenFile = "TOKEN_REFRESHER_TOKEN_FILE"
+	EnvExpiresAt = "TOKEN_REFRESHER_EXPIRES_AT"
+)
+
+// Event describes a successfully written token
+type Event struct {
+	TokenFile string    `json:"token_file"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Hooks notify the application after every token refresh, unset ones are skipped
+type Hooks struct {
+	Command     string        `mapstructure:"hook_command"`
+	URL         string        `mapstructure:"hook_url"`
+	Signal      string        `mapstructure:"hook_signal"`
+	ProcessName string        `mapstructure:"hook_process_name"`
+	PidFile     string        `mapstructure:"hook_pid_file"`
+	Timeout     time.Duration `mapstructure:"hook_timeout"`
+	MaxAttempts int           `mapstructure:"hook_max_attempts"`
+	Sleep       time.Duration `mapstructure:"hook_sleep"`
+}
+
+// Enabled returns true if at least one hook is configured
+func (h Hooks) Enabled() bool {
+	return h.Command != "" || h.URL != "" || h.Signal != ""
+}
+
+// Validate checks that the configured hooks can be fired
+func (h Hooks) Validate() error {
+	if h.Signal == "" {
+		return nil
+	}
+	if _, err := signals.Parse(h.Signal); err != nil {
+		return err
+	}
+	if h.ProcessName == "" && h.PidFile == "" {
+		return fmt.Errorf("signal hook needs either a process name or a pid file")
+	}
+	return nil
+}
+
+// Notify fires all configured hooks one after the other and logs their results to log.
+// The returned error joins the errors of all failed hooks.
+func (h Hooks) Notify(log logger.Logger, e Event) error {
+	var errs []error
+	if h.Command != "" {
+		errs = append(errs, h.fire(log, "exec", func(ctx context.Context) error { return h.exec(ctx, log, e) }))
+	}
+	if h.URL != "" {
+		errs = append(errs, h.fire(log, "http", func(ctx context.Context) error { return h.post(ctx, e) }))
+	}
+	if h.Signal != "" {
+		errs = append(errs, h.fire(log, "signal", func(context.Context) error { return h.signal(log) }))
+	}
+	return errors.Join(errs...)
+}
+
+func (h Hooks) fire(log logger.Logger, name string, f func(ctx context.Context) error) error {
+	start := time.Now()
+	attempts := 0
+	r := retry.Retryer{MaxAttempts: h.MaxAttempts, Sleep: h.Sleep}
+	err := r.DoWithLogger(log, func() (error, bool) {
+		attempts++
+		ctx, cancel := h.context()
+		defer cancel()
+		return f(ctx), true
+	})
+	if err != nil {
+		log.Errorf("Hook %s failed after %d attempt(s) in %v: %s", name, attempts, time.Since(start), err.Error())
+		return fmt.Errorf("hook %s: %w", name, err)
+	}
+	log.Infof("Hook %s succeeded after %d attempt(s) in %v", name, attempts, time.Since(start))
+	return nil
+}
+
+func (h Hooks) context() (context.Context, context.CancelFunc) {
+	if h.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), h.Timeout)
+}
+
+// exec runs the command in a shell with the token path and expiry in its environment
+func (h Hooks) exec(ctx context.Context, log logger.Logger, e Event) error {
+	cmd := process.ShellCommand(ctx, h.Command,
+		EnvTokenFile+"="+e.TokenFile,
+		EnvExpiresAt+"="+e.ExpiresAt.Format(time.RFC3339),
+	)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Infof("Hook exec output: %s", strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to run %q: %w", h.Command, err)
+	}
+	return nil
+}
+
+// post sends the event as json to the configured url
+func (h Hooks) post(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("unable to encode event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to post to %s: %w", h.URL, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status from %s: %s", h.URL, resp.Status)
+	}
+	return nil
+}
+
+// signal sends the configured signal to every matching process
+func (h Hooks) signal(log logger.Logger) error {
+	sig, err := signals.Parse(h.Signal)
+	if err != nil {
+		return err
+	}
+	pids, err := h.findProcesses()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, sig); err != nil {
+			return fmt.Errorf("unable to send %s to pid %d: %w", h.Signal, pid, err)
+		}
+		log.Infof("Sent %s to pid %d", h.Signal, pid)
+	}
+	return nil
+}
+
+func (h Hooks) findProcesses() ([]int, error) {
+	if h.PidFile != "" {
+		p, err := process.FromPidFile(h.PidFile)
+		if err != nil {
+			return nil, err
+		}
+		return []int{p.Pid}, nil
+	}
+	ps, err := process.FindByName(h.ProcessName)
+	if err != nil {
+		return nil, err
+	}
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no process named %s found", h.ProcessName)
+	}
+	pids := make([]int, 0, len(ps))
+	for _, p := range ps {
+		pids = append(pids, p.Pid)
+	}
+	return pids, nil
+}
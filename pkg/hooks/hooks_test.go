@@ -0,0 +1,140 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+)
+
+// recordingLogger keeps the logged lines
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.log(format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.log(format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...interface{})  { l.log(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.log(format, args...) }
+
+func (l *recordingLogger) log(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestHooks_Notify(t *testing.T) {
+	event := Event{TokenFile: "/tmp/token", ExpiresAt: time.Unix(1700000000, 0).UTC()}
+
+	t.Run("Notify() should run the command with token path and expiry in env", func(t *testing.T) {
+		out := path.Join(t.TempDir(), "out")
+		h := Hooks{Command: "printf %s,%s $TOKEN_REFRESHER_TOKEN_FILE $TOKEN_REFRESHER_EXPIRES_AT > '" + out + "'", Timeout: time.Second}
+
+		if err := h.Notify(logger.Std, event); err != nil {
+			t.Fatalf("Notify() failed: %s", err.Error())
+		}
+
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatalf("command did not run: %s", err.Error())
+		}
+		want := "/tmp/token,2023-11-14T22:13:20Z"
+		if string(got) != want {
+			t.Errorf("want: %s, got %s", want, string(got))
+		}
+	})
+
+	t.Run("Notify() should kill commands exceeding the timeout", func(t *testing.T) {
+		h := Hooks{Command: "sleep 5", Timeout: time.Millisecond * 100}
+
+		start := time.Now()
+		if err := h.Notify(logger.Std, event); err == nil {
+			t.Error("Notify() did not fail on timeout")
+		}
+		if time.Since(start) > time.Second*2 {
+			t.Errorf("Notify() did not respect the timeout")
+		}
+	})
+
+	t.Run("Notify() should retry failed http callbacks", func(t *testing.T) {
+		calls := 0
+		var got Event
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			calls++
+			if calls == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewDecoder(req.Body).Decode(&got)
+		}))
+		defer srv.Close()
+		h := Hooks{URL: srv.URL, Timeout: time.Second, MaxAttempts: 3, Sleep: time.Millisecond}
+		log := &recordingLogger{}
+
+		if err := h.Notify(log, event); err != nil {
+			t.Fatalf("Notify() failed: %s", err.Error())
+		}
+		if calls != 2 {
+			t.Errorf("want 2 calls, got %d", calls)
+		}
+		if !strings.Contains(strings.Join(log.lines, "\n"), "Retrying") || !strings.Contains(strings.Join(log.lines, "\n"), "Hook http succeeded") {
+			t.Errorf("want the retry and the result logged to the given logger, got %q", log.lines)
+		}
+		if got.TokenFile != event.TokenFile || !got.ExpiresAt.Equal(event.ExpiresAt) {
+			t.Errorf("want: %+v, got %+v", event, got)
+		}
+	})
+
+	t.Run("Notify() should signal the process from the pid file", func(t *testing.T) {
+		cmd := exec.Command("sleep", "10")
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("unable to start process: %s", err.Error())
+		}
+		pidFile := path.Join(t.TempDir(), "pid")
+		os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+		h := Hooks{Signal: "SIGTERM", PidFile: pidFile}
+
+		if err := h.Notify(logger.Std, event); err != nil {
+			t.Fatalf("Notify() failed: %s", err.Error())
+		}
+
+		done := make(chan error)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("process exited cleanly instead of being signalled")
+			}
+		case <-time.After(time.Second * 2):
+			cmd.Process.Kill()
+			t.Errorf("process was not signalled")
+		}
+	})
+}
+
+func TestHooks_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		hooks   Hooks
+		wantErr bool
+	}{
+		{"Accept no hooks", Hooks{}, false},
+		{"Accept signal with process name", Hooks{Signal: "HUP", ProcessName: "app"}, false},
+		{"Reject unknown signal", Hooks{Signal: "SIGFOO", ProcessName: "app"}, true},
+		{"Reject signal without target", Hooks{Signal: "SIGHUP"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.hooks.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level for one of debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %s", s)
+}
+
+var level atomic.Int32
+
+func init() {
+	SetLevel(LevelInfo)
+}
+
+// SetLevel changes the minimum level of messages being logged, it is safe to call at any time
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+func GetLevel() Level {
+	return Level(level.Load())
+}
+
+func Debugf(format string, args ...interface{}) { logf(LevelDebug, format, args...) }
+func Infof(format string, args ...interface{})  { logf(LevelInfo, format, args...) }
+func Warnf(format string, args ...interface{})  { logf(LevelWarn, format, args...) }
+func Errorf(format string, args ...interface{}) { logf(LevelError, format, args...) }
+
+func logf(l Level, format string, args ...interface{}) {
+	if l < GetLevel() {
+		return
+	}
+	fmt.Fprintf(os.Stdout, strings.TrimSuffix(format, "\n")+"\n", args...)
+}
+
+// Logger is implemented by anything which can log the refresher's messages
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type std struct{}
+
+func (std) Debugf(format string, args ...interface{}) { Debugf(format, args...) }
+func (std) Infof(format string, args ...interface{})  { Infof(format, args...) }
+func (std) Warnf(format string, args ...interface{})  { Warnf(format, args...) }
+func (std) Errorf(format string, args ...interface{}) { Errorf(format, args...) }
+
+// Std logs to stdout at the level set by SetLevel
+var Std Logger = std{}
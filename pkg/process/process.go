@@ -0,0 +1,206 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Process is a process of the shared process namespace. The start time tells it apart from a later process reusing its pid.
+type Process struct {
+	Pid       int
+	StartTime uint64
+	Cmdline   string
+}
+
+// Stat is the part of /proc/<pid>/stat needed to supervise a process
+type Stat struct {
+	State     byte
+	StartTime uint64
+	// ExitCode is the wait status, only set once the process has exited but was not yet reaped
+	ExitCode int
+}
+
+// ErrExited is returned for a pid file whose process is gone, or whose pid was reused by a later process
+var ErrExited = errors.New("the process has exited")
+
+// clockTicks is USER_HZ, the unit of the start time in /proc/<pid>/stat, which is 100 on all Linux architectures
+const clockTicks = 100
+
+// Find returns the processes whose command line, with arguments separated by spaces, matches the pattern
+func Find(pattern *regexp.Regexp) ([]Process, error) {
+	return find(func(pid int, cmdline string) bool {
+		return cmdline != "" && pattern.MatchString(cmdline)
+	})
+}
+
+// FindByName returns the processes whose name or executable matches the given name
+func FindByName(name string) ([]Process, error) {
+	return find(func(pid int, _ string) bool {
+		return readName(pid) == name
+	})
+}
+
+// find scans /proc for the processes other than this one which match.
+// Processes of other containers are only visible with a shared process namespace.
+func find(match func(pid int, cmdline string) bool) ([]Process, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list processes: %w", err)
+	}
+	self := os.Getpid()
+	var ps []Process
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		cmdline := readCmdline(pid)
+		if !match(pid, cmdline) {
+			continue
+		}
+		stat, err := ReadStat(pid)
+		if err != nil {
+			continue
+		}
+		ps = append(ps, Process{Pid: pid, StartTime: stat.StartTime, Cmdline: cmdline})
+	}
+	return ps, nil
+}
+
+// FromPidFile returns the process whose pid is written to the given file
+func FromPidFile(file string) (Process, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return Process{}, fmt.Errorf("unable to read pid file %s: %w", file, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return Process{}, fmt.Errorf("invalid pid in %s: %w", file, err)
+	}
+	stat, err := ReadStat(pid)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Process{}, fmt.Errorf("pid %d from %s: %w", pid, file, ErrExited)
+	}
+	if err != nil {
+		return Process{}, err
+	}
+	// A process started after the pid file was written cannot be the one which wrote it
+	if info, err := os.Stat(file); err == nil {
+		if started, err := startedAt(stat.StartTime); err == nil && started.After(info.ModTime()) {
+			return Process{}, fmt.Errorf("pid %d from %s was reused by a later process: %w", pid, file, ErrExited)
+		}
+	}
+	return Process{Pid: pid, StartTime: stat.StartTime, Cmdline: readCmdline(pid)}, nil
+}
+
+// startedAt converts the start time from /proc/<pid>/stat to wall clock time.
+// The boot time only has a resolution of seconds, so the result may be up to a second early.
+func startedAt(startTime uint64) (time.Time, error) {
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to read boot time: %w", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			btime, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid boot time: %w", err)
+			}
+			return time.Unix(btime, 0).Add(time.Duration(startTime) * time.Second / clockTicks), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("boot time not found in /proc/stat")
+}
+
+func readCmdline(pid int) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(b), "\x00", " "))
+}
+
+// readName returns the base name of the executable, or the command name if the command line is empty
+func readName(pid int) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err == nil && len(b) > 0 {
+		argv0, _, _ := strings.Cut(string(b), "\x00")
+		return path.Base(argv0)
+	}
+	b, err = os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// ReadStat parses /proc/<pid>/stat
+func ReadStat(pid int) (Stat, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return Stat{}, fmt.Errorf("unable to read stat of pid %d: %w", pid, err)
+	}
+	// The command name in parentheses may itself contain spaces and parentheses
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return Stat{}, fmt.Errorf("invalid stat of pid %d", pid)
+	}
+	// fields starts with field 3 (state), see proc(5)
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 20 {
+		return Stat{}, fmt.Errorf("invalid stat of pid %d", pid)
+	}
+	stat := Stat{State: fields[0][0]}
+	if stat.StartTime, err = strconv.ParseUint(fields[19], 10, 64); err != nil {
+		return Stat{}, fmt.Errorf("invalid start time of pid %d: %w", pid, err)
+	}
+	// exit_code (field 52) is only available since Linux 3.5
+	if len(fields) >= 50 {
+		stat.ExitCode, _ = strconv.Atoi(fields[49])
+	}
+	return stat, nil
+}
+
+// Exited checks whether the process has exited, describing its exit status if it is still known.
+// The exit status is lost once the process has been reaped by its parent.
+func (p Process) Exited() (bool, string) {
+	stat, err := ReadStat(p.Pid)
+	if err != nil || stat.StartTime != p.StartTime {
+		return true, "exit status unknown, the process was already reaped"
+	}
+	if stat.State != 'Z' && stat.State != 'X' {
+		return false, ""
+	}
+	return true, describe(syscall.WaitStatus(stat.ExitCode))
+}
+
+func describe(ws syscall.WaitStatus) string {
+	switch {
+	case ws.Exited():
+		return fmt.Sprintf("exit status %d", ws.ExitStatus())
+	case ws.Signaled():
+		return fmt.Sprintf("killed by signal %s", ws.Signal())
+	}
+	return fmt.Sprintf("wait status %d", int(ws))
+}
+
+// ShellCommand runs the command in a shell with the given variables added to the environment.
+// The whole process group is killed once ctx is done, so that children of the shell do not outlive it.
+func ShellCommand(ctx context.Context, command string, env ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+	return cmd
+}
@@ -0,0 +1,131 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProcess(t *testing.T) {
+	// the argument makes the command line unique among concurrently running tests
+	arg := "30." + strconv.Itoa(os.Getpid())
+	pattern := regexp.MustCompile(`^sleep ` + regexp.QuoteMeta(arg) + `$`)
+	cmd := exec.Command("sleep", arg)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unable to start process: %s", err.Error())
+	}
+	defer cmd.Process.Kill()
+
+	t.Run("Find() should match the command line", func(t *testing.T) {
+		var ps []Process
+		var err error
+		// the child might not have exec'd sleep yet
+		for deadline := time.Now().Add(5 * time.Second); len(ps) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if ps, err = Find(pattern); err != nil {
+				t.Fatalf("Find() failed: %s", err.Error())
+			}
+		}
+		if len(ps) != 1 || ps[0].Pid != cmd.Process.Pid {
+			t.Fatalf("want pid %d, got %v", cmd.Process.Pid, ps)
+		}
+		if exited, _ := ps[0].Exited(); exited {
+			t.Errorf("Exited() reported a running process as exited")
+		}
+	})
+
+	t.Run("FindByName() should match the executable", func(t *testing.T) {
+		ps, err := FindByName("sleep")
+		if err != nil {
+			t.Fatalf("FindByName() failed: %s", err.Error())
+		}
+		if !slices.ContainsFunc(ps, func(p Process) bool { return p.Pid == cmd.Process.Pid }) {
+			t.Errorf("want pid %d, got %v", cmd.Process.Pid, ps)
+		}
+	})
+
+	t.Run("FromPidFile() should read the pid", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "app.pid")
+		os.WriteFile(file, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+		p, err := FromPidFile(file)
+		if err != nil {
+			t.Fatalf("FromPidFile() failed: %s", err.Error())
+		}
+		if p.Pid != cmd.Process.Pid || p.Cmdline != "sleep "+arg {
+			t.Errorf("unexpected process %+v", p)
+		}
+	})
+
+	t.Run("FromPidFile() should report a reused pid as exited", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "app.pid")
+		os.WriteFile(file, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+		written := time.Now().Add(-time.Hour)
+		os.Chtimes(file, written, written)
+		if _, err := FromPidFile(file); !errors.Is(err, ErrExited) {
+			t.Errorf("want ErrExited, got %v", err)
+		}
+	})
+
+	t.Run("Exited() should report the exit status until the process is reaped", func(t *testing.T) {
+		ps, _ := Find(pattern)
+		if len(ps) != 1 {
+			t.Fatalf("process not found")
+		}
+		cmd.Process.Kill()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			exited, status := ps[0].Exited()
+			if exited {
+				if status != "killed by signal killed" {
+					t.Errorf("unexpected exit status %q", status)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Exited() did not report the killed process")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cmd.Wait()
+		if exited, status := ps[0].Exited(); !exited || status != "exit status unknown, the process was already reaped" {
+			t.Errorf("unexpected exit status of reaped process %v %q", exited, status)
+		}
+	})
+
+	t.Run("FromPidFile() should report a vanished process as exited", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "app.pid")
+		os.WriteFile(file, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+		if _, err := FromPidFile(file); !errors.Is(err, ErrExited) {
+			t.Errorf("want ErrExited, got %v", err)
+		}
+	})
+}
+
+func TestShellCommand(t *testing.T) {
+	t.Run("ShellCommand() should add the variables to the environment", func(t *testing.T) {
+		out, err := ShellCommand(context.Background(), "printf %s $PROCESS_TEST", "PROCESS_TEST=value").Output()
+		if err != nil || string(out) != "value" {
+			t.Errorf("want the variable in the environment, got %q, %v", out, err)
+		}
+	})
+
+	t.Run("ShellCommand() should kill the children of the shell once ctx is done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		// the child holds the output pipe open unless it is killed along with the shell
+		_, err := ShellCommand(ctx, "sleep 30 & wait").CombinedOutput()
+		if err == nil {
+			t.Errorf("want an error as the command was killed")
+		}
+		if d := time.Since(start); d > 900*time.Millisecond {
+			t.Errorf("want the process group killed right away, took %v", d)
+		}
+	})
+}
@@ -1,8 +1,9 @@
 package retry
 
 import (
-	"fmt"
 	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
 )
 
 type Retryer struct {
@@ -10,21 +11,33 @@ type Retryer struct {
 	Sleep       time.Duration `mapstructure:"sleep"`
 }
 
+// Deprecated: use DoWithLogger
 func (r Retryer) Do(f func() (error, bool)) error {
-	return Retry(r.MaxAttempts, r.Sleep, f)
+	return r.DoWithLogger(logger.Std, f)
+}
+
+func (r Retryer) DoWithLogger(log logger.Logger, f func() (error, bool)) error {
+	return RetryWithLogger(log, r.MaxAttempts, r.Sleep, f)
 }
 
+// Deprecated: use RetryWithLogger
 func Retry(attempts int, sleep time.Duration, f func() (error, bool)) error {
+	return RetryWithLogger(logger.Std, attempts, sleep, f)
+}
+
+// RetryWithLogger calls f until it succeeds, fails with an error which is not retryable or runs out of attempts.
+// The retries are logged to log.
+func RetryWithLogger(log logger.Logger, attempts int, sleep time.Duration, f func() (error, bool)) error {
 	if err, isRetryable := f(); err != nil {
 		if !isRetryable {
 			return err
 		}
 
 		if attempts = attempts - 1; attempts > 0 {
-			fmt.Printf("Error: %s, Sleeping for %v before retrying\n", err.Error(), sleep)
+			log.Warnf("Error: %s, Sleeping for %v before retrying", err.Error(), sleep)
 			time.Sleep(sleep)
-			fmt.Printf("Retrying with remaining attempts: %v\n", attempts)
-			return Retry(attempts, sleep, f)
+			log.Infof("Retrying with remaining attempts: %v", attempts)
+			return RetryWithLogger(log, attempts, sleep, f)
 		}
 		return err
 	}
@@ -0,0 +1,45 @@
+package signals
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+)
+
+// Control signals change what the running refresher does without shutting it down
+var (
+	// ForceRefresh refreshes the token right away, entering the active phase if needed
+	ForceRefresh os.Signal = syscall.SIGUSR1
+	// Reload reloads the configuration
+	Reload os.Signal = syscall.SIGHUP
+	// DumpState prints a snapshot of the refresher's state
+	DumpState os.Signal = syscall.SIGUSR2
+)
+
+// Handle calls the handler of every received signal, one at a time, until ctx is done or the returned stop is called.
+// Signals received while a handler runs are coalesced. Received signals are logged to log.
+func Handle(ctx context.Context, log logger.Logger, handlers map[os.Signal]func()) (stop func()) {
+	ch := make(chan os.Signal, len(handlers))
+	sigs := make([]os.Signal, 0, len(handlers))
+	for sig := range handlers {
+		sigs = append(sigs, sig)
+	}
+	signal.Notify(ch, sigs...)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case sig := <-ch:
+				log.Infof("Received %s", sig)
+				handlers[sig]()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return cancel
+}
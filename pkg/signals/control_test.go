@@ -0,0 +1,28 @@
+package signals
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+)
+
+func TestHandle(t *testing.T) {
+	called := make(chan struct{}, 1)
+	stop := Handle(context.Background(), logger.Std, map[os.Signal]func(){
+		syscall.SIGUSR1: func() { called <- struct{}{} },
+	})
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("unable to send signal: %s", err.Error())
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Errorf("handler was not called")
+	}
+}
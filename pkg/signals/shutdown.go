@@ -1,26 +1,225 @@
 package signals
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
 )
 
-// onlyOneHandler ensures at most 1 shutdown handler is registered
-var onlyOneHandler = make(chan struct{})
+// Stage is how far the shutdown has escalated
+type Stage int
+
+const (
+	// StageTrigger is entered on the first signal, the refresher starts refreshing tokens
+	StageTrigger Stage = iota + 1
+	// StageStop gracefully stops the refresh loop
+	StageStop
+	// StageForce exits the process right away
+	StageForce
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageTrigger:
+		return "trigger"
+	case StageStop:
+		return "stop"
+	case StageForce:
+		return "force"
+	}
+	return fmt.Sprintf("stage(%d)", int(s))
+}
+
+// Reason records the signal which escalated the shutdown to a stage. It is the cause of the stage's context.
+type Reason struct {
+	Signal os.Signal
+	Stage  Stage
+	// Count is the number of signals received within the window, including this one
+	Count int
+}
+
+func (r *Reason) Error() string {
+	return fmt.Sprintf("received %s (%d within window), entering %s stage", r.Signal, r.Count, r.Stage)
+}
+
+// Config sets which signals are handled and how many of them within the window escalate the shutdown
+type Config struct {
+	Signals []os.Signal
+	// StopCount signals within the window stop the refresh loop, 0 disables the stop stage
+	StopCount int
+	// ForceCount signals within the window exit the process, 0 disables the force stage
+	ForceCount int
+	Window     time.Duration
+	// Exit is called with 128 + the signal number on the force stage, defaults to os.Exit
+	Exit func(code int)
+	// Log receives the shutdown stages, defaults to logger.Std
+	Log logger.Logger
+}
+
+// DefaultConfig handles SIGTERM and SIGINT, stops on the second and forces an exit on the third within 10s
+func DefaultConfig() Config {
+	return Config{
+		Signals:    []os.Signal{syscall.SIGTERM, syscall.SIGINT},
+		StopCount:  2,
+		ForceCount: 3,
+		Window:     10 * time.Second,
+	}
+}
+
+// Shutdown handles the shutdown signals in stages. Unlike signal.NotifyContext, further signals are never
+// passed on to the default handler, so that they cannot kill the process in the middle of writing a token.
+type Shutdown struct {
+	cfg                       Config
+	trigger, stop             context.Context
+	cancelTrigger, cancelStop context.CancelCauseFunc
+	ch                        chan os.Signal
+	done                      chan struct{}
+	closeOnce                 sync.Once
+}
+
+// NotifyShutdown starts handling the configured signals until Close is called or parent is done.
+// It can be called any number of times, every Shutdown receives its own copy of the signals.
+func NotifyShutdown(parent context.Context, cfg Config) *Shutdown {
+	if cfg.Exit == nil {
+		cfg.Exit = os.Exit
+	}
+	if cfg.Log == nil {
+		cfg.Log = logger.Std
+	}
+	s := &Shutdown{
+		cfg:  cfg,
+		ch:   make(chan os.Signal, 1),
+		done: make(chan struct{}),
+	}
+	s.trigger, s.cancelTrigger = context.WithCancelCause(parent)
+	s.stop, s.cancelStop = context.WithCancelCause(parent)
+	signal.Notify(s.ch, cfg.Signals...)
+	go s.handle(parent)
+	return s
+}
 
 // SignalShutdown returns a stop channel which is closed on receiving an interrupt signal,
-// giving the application a chance to shutdown gracefully. After the first signal,
-// it forwards any further signals directly to the application causing it to force-quit.
+// giving the application a chance to shutdown gracefully. Any further signal force-quits the application.
+//
+// Deprecated: use NotifyShutdown, which can also stop gracefully before force-quitting.
 func SignalShutdown() <-chan struct{} {
-	close(onlyOneHandler) // panics when called more than once
-	stopCh := make(chan struct{})
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		signal.Reset()
-		close(stopCh)
-	}()
-	return stopCh
+	return NotifyShutdown(context.Background(), Config{
+		Signals:    []os.Signal{os.Interrupt, syscall.SIGTERM},
+		ForceCount: 2,
+		Window:     math.MaxInt64,
+	}).Triggered().Done()
+}
+
+// Triggered is done on the first signal
+func (s *Shutdown) Triggered() context.Context {
+	return s.trigger
+}
+
+// Stopped is done once StopCount signals were received within the window
+func (s *Shutdown) Stopped() context.Context {
+	return s.stop
+}
+
+// Close stops handling signals and cancels both contexts if they are not done yet
+func (s *Shutdown) Close() {
+	s.closeOnce.Do(func() {
+		signal.Stop(s.ch)
+		close(s.done)
+		s.cancelTrigger(nil)
+		s.cancelStop(nil)
+	})
+}
+
+func (s *Shutdown) handle(parent context.Context) {
+	var received []time.Time
+	for {
+		select {
+		case sig := <-s.ch:
+			now := time.Now()
+			// only the signals within the window count towards escalation
+			recent := received[:0]
+			for _, t := range received {
+				if now.Sub(t) < s.cfg.Window {
+					recent = append(recent, t)
+				}
+			}
+			received = append(recent, now)
+			s.escalate(sig, len(received))
+		case <-parent.Done():
+			s.Close()
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Shutdown) escalate(sig os.Signal, count int) {
+	reason := &Reason{Signal: sig, Stage: StageTrigger, Count: count}
+	switch {
+	case s.cfg.ForceCount > 0 && count >= s.cfg.ForceCount:
+		reason.Stage = StageForce
+		s.cfg.Log.Errorf("Shutdown: %s, exiting", reason.Error())
+		code := 1
+		if num, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(num)
+		}
+		s.cfg.Exit(code)
+		return
+	case s.cfg.StopCount > 0 && count >= s.cfg.StopCount:
+		reason.Stage = StageStop
+		s.cfg.Log.Infof("Shutdown: %s", reason.Error())
+		s.cancelTrigger(reason)
+		s.cancelStop(reason)
+	default:
+		if s.trigger.Err() == nil {
+			s.cfg.Log.Infof("Shutdown: %s", reason.Error())
+		}
+		s.cancelTrigger(reason)
+	}
+}
+
+// ReasonOf returns why a context of Shutdown is done, or nil if it is not done or was not ended by a signal
+func ReasonOf(ctx context.Context) *Reason {
+	r, _ := context.Cause(ctx).(*Reason)
+	return r
+}
+
+var names = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// Parse returns the signal with the given name, with or without the SIG prefix
+func Parse(name string) (syscall.Signal, error) {
+	sig, ok := names[strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal: %s", name)
+	}
+	return sig, nil
+}
+
+// ParseAll parses a list of signal names
+func ParseAll(names []string) ([]os.Signal, error) {
+	sigs := make([]os.Signal, 0, len(names))
+	for _, name := range names {
+		sig, err := Parse(name)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
 }
@@ -0,0 +1,82 @@
+package signals
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyShutdown(t *testing.T) {
+	exited := make(chan int, 1)
+	cfg := Config{
+		Signals:    []os.Signal{syscall.SIGUSR2},
+		StopCount:  2,
+		ForceCount: 3,
+		Window:     time.Second,
+		Exit:       func(code int) { exited <- code },
+	}
+	send := func() {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+			t.Fatalf("unable to send signal: %s", err.Error())
+		}
+	}
+	done := func(ctx context.Context) bool {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	// Constructing it more than once must not panic
+	other := NotifyShutdown(context.Background(), cfg)
+	other.Close()
+	s := NotifyShutdown(context.Background(), cfg)
+	defer s.Close()
+
+	send()
+	if !done(s.Triggered()) {
+		t.Fatalf("first signal did not trigger")
+	}
+	if r := ReasonOf(s.Triggered()); r == nil || r.Stage != StageTrigger || r.Count != 1 {
+		t.Errorf("unexpected trigger reason %v", r)
+	}
+	if done(s.Stopped()) {
+		t.Fatalf("first signal stopped")
+	}
+	if done(other.Triggered()) && ReasonOf(other.Triggered()) != nil {
+		t.Errorf("closed shutdown still received signals")
+	}
+
+	send()
+	if !done(s.Stopped()) {
+		t.Fatalf("second signal did not stop")
+	}
+	if r := ReasonOf(s.Stopped()); r == nil || r.Stage != StageStop || r.Count != 2 {
+		t.Errorf("unexpected stop reason %v", r)
+	}
+
+	send()
+	select {
+	case code := <-exited:
+		if code != 128+int(syscall.SIGUSR2) {
+			t.Errorf("want exit code %d, got %d", 128+int(syscall.SIGUSR2), code)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("third signal did not force an exit")
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, name := range []string{"SIGHUP", "hup", " TERM "} {
+		if _, err := Parse(name); err != nil {
+			t.Errorf("Parse(%q) failed: %s", name, err.Error())
+		}
+	}
+	if _, err := Parse("SIGKILL"); err == nil {
+		t.Errorf("Parse() did not fail on an unsupported signal")
+	}
+}
@@ -0,0 +1,130 @@
+package tokenrefresher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+)
+
+// AdminSettings configure the local admin API, which is disabled unless an address is set
+type AdminSettings struct {
+	Addr  string `mapstructure:"admin_addr"`
+	Pprof bool   `mapstructure:"admin_pprof"`
+}
+
+func (a *AdminSettings) enabled() bool {
+	return a.Addr != ""
+}
+
+func (a *AdminSettings) validate() error {
+	if !a.enabled() {
+		if a.Pprof {
+			return fmt.Errorf("admin address is required to serve pprof")
+		}
+		return nil
+	}
+	return validateLocalAddr("admin", a.Addr)
+}
+
+// serveAdmin serves the admin API until the returned function is called
+func (r *TokenRefresher) serveAdmin() (func(), error) {
+	l, err := listenLocal(r.Admin.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on admin address %s: %w", r.Admin.Addr, err)
+	}
+	srv := &http.Server{Handler: r.adminHandler(), ConnContext: withPeerUID}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			r.log().Errorf("unable to serve admin API on %s: %s", r.Admin.Addr, err.Error())
+		}
+	}()
+	r.log().Infof("Serving admin API on %s", r.Admin.Addr)
+	return func() { srv.Close() }, nil
+}
+
+func (r *TokenRefresher) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refresh", post(func(w http.ResponseWriter, req *http.Request) {
+		r.ForceRefresh()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	mux.HandleFunc("/trigger", post(func(w http.ResponseWriter, req *http.Request) {
+		if err := r.Activate("Admin API trigger from " + r.adminPeer(req)); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	mux.HandleFunc("/stop", post(func(w http.ResponseWriter, req *http.Request) {
+		if err := r.Stop(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s := r.State()
+		s.Claims = redactClaims(s.Claims)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s); err != nil {
+			r.log().Errorf("unable to write status: %s", err.Error())
+		}
+	})
+	if r.Admin.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// adminPeer describes who sent the request. Requests on a Unix socket have no remote address,
+// so the peer's uid and the socket are used instead.
+func (r *TokenRefresher) adminPeer(req *http.Request) string {
+	if req.RemoteAddr != "" && req.RemoteAddr != "@" {
+		return req.RemoteAddr
+	}
+	if uid, ok := req.Context().Value(peerUIDKey{}).(int); ok {
+		return fmt.Sprintf("uid %d on %s", uid, r.Admin.Addr)
+	}
+	return r.Admin.Addr
+}
+
+// post rejects any method but POST, so that the actions cannot be triggered by a mere GET
+func post(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// publicClaims are shown as they are by the admin API, the values of all other claims are redacted
+var publicClaims = map[string]bool{"iss": true, "aud": true, "exp": true, "iat": true, "nbf": true}
+
+func redactClaims(claims map[string]interface{}) map[string]interface{} {
+	if claims == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		if publicClaims[k] {
+			redacted[k] = v
+		} else {
+			redacted[k] = "REDACTED"
+		}
+	}
+	return redacted
+}
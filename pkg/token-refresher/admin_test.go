@@ -0,0 +1,189 @@
+package tokenrefresher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestAdminSettings_validate(t *testing.T) {
+	tests := []struct {
+		addr    string
+		pprof   bool
+		wantErr bool
+	}{
+		{addr: ""},
+		{addr: "localhost:8083"},
+		{addr: "127.0.0.1:8083"},
+		{addr: "[::1]:8083"},
+		{addr: "unix:/run/token-refresher/admin.sock"},
+		{addr: ":8083", wantErr: true},
+		{addr: "0.0.0.0:8083", wantErr: true},
+		{addr: "unix:", wantErr: true},
+		{addr: "", pprof: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		a := &AdminSettings{Addr: tt.addr, Pprof: tt.pprof}
+		if err := a.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() of %q, error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTokenRefresher_adminHandler(t *testing.T) {
+	t.Run("GET /status should return the state with redacted claims", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, getTokenWithExpiry(time.Hour))
+		rec := httptest.NewRecorder()
+
+		r.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("want status %d, got %d", http.StatusOK, rec.Code)
+		}
+		var s State
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatalf("unable to decode status: %s", err.Error())
+		}
+		if s.Phase != PhaseInitializing {
+			t.Errorf("want phase %s, got %s", PhaseInitializing, s.Phase)
+		}
+		if s.Claims["exp"] == nil || s.Claims["exp"] == "REDACTED" {
+			t.Errorf("want exp claim, got %v", s.Claims["exp"])
+		}
+		for k, v := range s.Claims {
+			if !publicClaims[k] && v != "REDACTED" {
+				t.Errorf("claim %s was not redacted: %v", k, v)
+			}
+		}
+	})
+
+	t.Run("POST /stop should write the shutdown file", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		rec := httptest.NewRecorder()
+
+		r.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/stop", nil))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("want status %d, got %d", http.StatusAccepted, rec.Code)
+		}
+		if !r.shouldShutdown() {
+			t.Errorf("POST /stop did not write the shutdown file")
+		}
+	})
+
+	t.Run("POST /trigger should end the passive phase", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, getTokenWithExpiry(time.Hour*2))
+		r.setPhase(PhasePassive)
+		retCh := make(chan []string)
+
+		go func() {
+			fired, _ := r.waitForTrigger(context.Background(), nil, make(chan struct{}))
+			retCh <- fired
+		}()
+
+		rec := httptest.NewRecorder()
+		r.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/trigger", nil))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("want status %d, got %d", http.StatusAccepted, rec.Code)
+		}
+		select {
+		case fired := <-retCh:
+			if len(fired) != 1 || fired[0] != TriggerManual {
+				t.Errorf("want trigger %s, got %v", TriggerManual, fired)
+			}
+		case <-time.After(r.RefreshInterval * 2):
+			t.Errorf("waitForTrigger() did not return on POST /trigger")
+		}
+	})
+
+	t.Run("POST /trigger should be rejected once active", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.setPhase(PhaseActive)
+
+		rec := httptest.NewRecorder()
+		r.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/trigger", nil))
+		if rec.Code != http.StatusConflict {
+			t.Errorf("want status %d, got %d", http.StatusConflict, rec.Code)
+		}
+		select {
+		case reason := <-r.activateCh():
+			t.Errorf("want no pending activation, got %s", reason)
+		default:
+		}
+	})
+
+	t.Run("actions should only be taken on POST", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		for _, p := range []string{"/refresh", "/trigger", "/stop"} {
+			rec := httptest.NewRecorder()
+			r.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Errorf("GET %s: want status %d, got %d", p, http.StatusMethodNotAllowed, rec.Code)
+			}
+		}
+	})
+}
+
+func TestTokenRefresher_serveAdmin(t *testing.T) {
+	r, cleanup := setup()
+	defer cleanup()
+	socket := path.Join(t.TempDir(), "admin.sock")
+	// a stale socket of a previous run must not prevent serving
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	r.Admin = AdminSettings{Addr: unixPrefix + socket}
+
+	closeAdmin, err := r.serveAdmin()
+	if err != nil {
+		t.Fatalf("serveAdmin() failed: %s", err.Error())
+	}
+	defer closeAdmin()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://admin/status")
+	if err != nil {
+		t.Fatalf("unable to get status: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		t.Errorf("admin socket was not created")
+	}
+
+	r.setPhase(PhasePassive)
+	resp, err = client.Post("http://admin/trigger", "", nil)
+	if err != nil {
+		t.Fatalf("unable to trigger: %s", err.Error())
+	}
+	resp.Body.Close()
+	want := fmt.Sprintf("Admin API trigger from uid %d on %s", os.Getuid(), r.Admin.Addr)
+	select {
+	case reason := <-r.activateCh():
+		if reason != want {
+			t.Errorf("want activation reason %q, got %q", want, reason)
+		}
+	default:
+		t.Errorf("POST /trigger did not request an activation")
+	}
+}
@@ -0,0 +1,80 @@
+package tokenrefresher
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// updateDeadline looks up when the pod is going to be killed, unless it is already known.
+// The deletionTimestamp of a terminating pod is the end of its grace period. If the pod is not yet
+// marked for deletion but the refresher was triggered by a shutdown signal, the grace period is
+// assumed to have started now.
+func (r *TokenRefresher) updateDeadline(client kubernetes.Interface, signalled bool) {
+	if !r.deadline.IsZero() {
+		return
+	}
+	pod, err := getPod(client, r.Namespace, r.PodName)
+	if err != nil {
+		r.log().Warnf("unable to look up termination deadline: %s", err.Error())
+		return
+	}
+	var deadline time.Time
+	switch {
+	case pod.DeletionTimestamp != nil:
+		deadline = pod.DeletionTimestamp.Time
+	case signalled && pod.Spec.TerminationGracePeriodSeconds != nil:
+		deadline = r.now().Add(time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second)
+	default:
+		r.log().Debugf("pod %s/%s is not terminating", r.Namespace, r.PodName)
+		return
+	}
+	r.mu.Lock()
+	r.deadline = deadline
+	r.mu.Unlock()
+	r.log().Infof("Pod %s/%s will be killed at %s, tokens will not outlive it", r.Namespace, r.PodName, r.deadline.Format(time.RFC3339))
+}
+
+// deadlinePassed reports whether the pod should already have been killed
+func (r *TokenRefresher) deadlinePassed() bool {
+	return !r.deadline.IsZero() && !r.now().Before(r.deadline)
+}
+
+// boundedExpiration returns the expiration to request and how long the token must at least be valid.
+// Both are cut to the time left until the termination deadline, so that the token does not outlive the pod.
+func (r *TokenRefresher) boundedExpiration() (time.Duration, time.Duration) {
+	exp, minExp := r.expiration(), r.minExpiry()
+	// also used by the token API, concurrently with the refresh loop
+	r.mu.RLock()
+	deadline := r.deadline
+	r.mu.RUnlock()
+	if deadline.IsZero() {
+		return exp, minExp
+	}
+	if left := deadline.Sub(r.now()).Truncate(time.Second); left < exp {
+		exp = left
+		// leave some slack for the time it takes to issue the token
+		if minExp > exp-exp/10 {
+			minExp = exp - exp/10
+		}
+	}
+	return exp, minExp
+}
+
+// checkDeadline returns an error if no token should be refreshed because of the termination deadline:
+// the API server does not issue tokens shorter than MinExpirationDuration, so close to the deadline
+// the last token, which was cut to the deadline, is kept instead.
+func (r *TokenRefresher) checkDeadline() error {
+	// also used by the token API, concurrently with the refresh loop
+	r.mu.RLock()
+	deadline := r.deadline
+	r.mu.RUnlock()
+	if deadline.IsZero() {
+		return nil
+	}
+	if left := deadline.Sub(r.now()); left < MinExpirationDuration {
+		return fmt.Errorf("only %v left until the termination deadline, less than the minimum expiration duration %v", left.Truncate(time.Second), MinExpirationDuration)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package tokenrefresher
+
+import (
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesing "k8s.io/client-go/testing"
+)
+
+func TestTokenRefresher_updateDeadline(t *testing.T) {
+	pod := func(deletion *metav1.Time) *corev1.Pod {
+		grace := int64(300)
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-ns", DeletionTimestamp: deletion},
+			Spec:       corev1.PodSpec{TerminationGracePeriodSeconds: &grace},
+		}
+	}
+
+	t.Run("updateDeadline() should use the deletion timestamp of a terminating pod", func(t *testing.T) {
+		r := &TokenRefresher{Namespace: "test-ns", PodName: "test-pod"}
+		want := metav1.NewTime(time.Now().Add(time.Hour).Truncate(time.Second))
+		c := testclient.NewSimpleClientset(pod(&want))
+
+		r.updateDeadline(c, false)
+		if !r.deadline.Equal(want.Time) {
+			t.Errorf("want deadline %v, got %v", want.Time, r.deadline)
+		}
+	})
+
+	t.Run("updateDeadline() should start the grace period on the shutdown signal", func(t *testing.T) {
+		r := &TokenRefresher{Namespace: "test-ns", PodName: "test-pod"}
+		c := testclient.NewSimpleClientset(pod(nil))
+
+		r.updateDeadline(c, true)
+		if left := time.Until(r.deadline); left <= 290*time.Second || left > 300*time.Second {
+			t.Errorf("want deadline in 300s, got %v", left)
+		}
+	})
+
+	t.Run("updateDeadline() should leave the deadline unknown while the pod is running", func(t *testing.T) {
+		r := &TokenRefresher{Namespace: "test-ns", PodName: "test-pod"}
+		c := testclient.NewSimpleClientset(pod(nil))
+
+		r.updateDeadline(c, false)
+		if !r.deadline.IsZero() {
+			t.Errorf("want no deadline, got %v", r.deadline)
+		}
+	})
+}
+
+func TestTokenRefresher_refreshDeadline(t *testing.T) {
+	t.Run("refresh() should cut the token expiration to the deadline", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		r.deadline = time.Now().Add(30 * time.Minute)
+		var got int64
+		c := testclient.NewSimpleClientset()
+		c.PrependReactor("create", "serviceaccounts", func(action k8stesing.Action) (bool, runtime.Object, error) {
+			ret := action.(k8stesing.CreateActionImpl).GetObject().DeepCopyObject().(*authv1.TokenRequest)
+			got = *ret.Spec.ExpirationSeconds
+			ret.Status.Token = getTokenWithExpiry(time.Duration(got) * time.Second)
+			return true, ret, nil
+		})
+
+		if err := r.refresh(c); err != nil {
+			t.Fatalf("refresh() failed: %s", err.Error())
+		}
+		if got > 30*60 || got < 29*60 {
+			t.Errorf("want expiration of about 1800s, got %ds", got)
+		}
+	})
+
+	t.Run("refreshLoop() should exit once the deadline has passed", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		c := getFakeClient(r, false)
+		r.TerminationDeadline = true
+		r.deadline = time.Now().Add(r.RefreshInterval)
+		retCh := make(chan struct{})
+
+		go func() {
+			r.refreshLoop(c, nil)
+			close(retCh)
+		}()
+
+		select {
+		case <-retCh:
+		case <-time.After(r.RefreshInterval * 3):
+			t.Errorf("refreshLoop() did not return after the deadline")
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package tokenrefresher
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultExpirationDuration is used when no expiration duration is configured or discovered
+const DefaultExpirationDuration = 2 * time.Hour
+
+// namespaceFile is mounted into every pod which automounts its service account token
+var namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+const serviceAccountSubjectPrefix = "system:serviceaccount:"
+
+// Discover fills in unset settings from the pod: the namespace from the automounted namespace file,
+// and the service account, audience and expiration duration from the claims of the default token.
+// Settings which cannot be discovered are left unset.
+func (r *TokenRefresher) Discover() {
+	r.discoverIdentity()
+	r.discoverToken()
+}
+
+// discoverIdentity fills in the namespace and service account the token is requested for
+func (r *TokenRefresher) discoverIdentity() {
+	if r.Namespace == "" {
+		if b, err := os.ReadFile(namespaceFile); err == nil {
+			r.Namespace = strings.TrimSpace(string(b))
+			r.log().Infof("Discovered namespace %s from %s", r.Namespace, namespaceFile)
+		} else {
+			r.log().Debugf("unable to read namespace file: %s", err.Error())
+		}
+	}
+	if r.Namespace != "" && r.ServiceAccount != "" {
+		return
+	}
+	claims, err := r.defaultTokenClaims()
+	if err != nil {
+		r.log().Warnf("unable to discover service account: %s", err.Error())
+		return
+	}
+	ns, sa, err := serviceAccountFromSubject(claims["sub"])
+	if err != nil {
+		r.log().Warnf("unable to discover service account: %s", err.Error())
+		return
+	}
+	if r.Namespace == "" {
+		r.Namespace = ns
+		r.log().Infof("Discovered namespace %s from the sub claim of %s", r.Namespace, r.DefaultTokenFile)
+	}
+	if r.ServiceAccount == "" {
+		r.ServiceAccount = sa
+		r.log().Infof("Discovered service account %s from the sub claim of %s", r.ServiceAccount, r.DefaultTokenFile)
+	}
+}
+
+// discoverToken fills in the audience and expiration duration so that refreshed tokens match the default one
+func (r *TokenRefresher) discoverToken() {
+	if len(r.TokenAudience) > 0 && r.ExpirationDuration != 0 {
+		return
+	}
+	claims, err := r.defaultTokenClaims()
+	if err != nil {
+		r.log().Warnf("unable to discover token audience and expiration: %s", err.Error())
+		return
+	}
+	if len(r.TokenAudience) == 0 {
+		r.TokenAudience = audienceFromClaim(claims["aud"])
+		if len(r.TokenAudience) == 0 {
+			r.log().Infof("No audience found in the aud claim of %s, tokens are requested for the API server's default audience", r.DefaultTokenFile)
+		} else {
+			r.log().Infof("Discovered token audience %v from the aud claim of %s", r.TokenAudience, r.DefaultTokenFile)
+		}
+	}
+	if r.ExpirationDuration == 0 {
+		exp, expOk := claims["exp"].(float64)
+		iat, iatOk := claims["iat"].(float64)
+		if expOk && iatOk && exp > iat {
+			r.ExpirationDuration = time.Duration(exp-iat) * time.Second
+			r.log().Infof("Discovered expiration duration %v from the exp and iat claims of %s", r.ExpirationDuration, r.DefaultTokenFile)
+		} else {
+			r.log().Warnf("unable to discover expiration duration from exp %v and iat %v", claims["exp"], claims["iat"])
+		}
+	}
+}
+
+func (r *TokenRefresher) defaultTokenClaims() (map[string]interface{}, error) {
+	b, err := os.ReadFile(r.DefaultTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read default token: %w", err)
+	}
+	return parseClaims(string(b))
+}
+
+// expiration returns the configured or discovered expiration duration, falling back to the default
+func (r *TokenRefresher) expiration() time.Duration {
+	if r.ExpirationDuration == 0 {
+		return DefaultExpirationDuration
+	}
+	return r.ExpirationDuration
+}
+
+// serviceAccountFromSubject splits a subject of the form system:serviceaccount:<namespace>:<name>
+func serviceAccountFromSubject(sub interface{}) (string, string, error) {
+	s, ok := sub.(string)
+	if !ok || !strings.HasPrefix(s, serviceAccountSubjectPrefix) {
+		return "", "", fmt.Errorf("sub is not a service account: %v", sub)
+	}
+	ns, sa, ok := strings.Cut(strings.TrimPrefix(s, serviceAccountSubjectPrefix), ":")
+	if !ok || ns == "" || sa == "" {
+		return "", "", fmt.Errorf("sub is not a service account: %v", sub)
+	}
+	return ns, sa, nil
+}
+
+// audienceFromClaim handles both forms of the aud claim, a single string or a list of strings
+func audienceFromClaim(aud interface{}) []string {
+	switch aud := aud.(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var audiences []string
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+		return audiences
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package tokenrefresher
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenRefresher_Discover(t *testing.T) {
+	setupDiscovery := func(t *testing.T, claims string) *TokenRefresher {
+		dir := t.TempDir()
+		nsFile := path.Join(dir, "namespace")
+		os.WriteFile(nsFile, []byte("pod-ns\n"), 0644)
+		orig := namespaceFile
+		namespaceFile = nsFile
+		t.Cleanup(func() { namespaceFile = orig })
+		r := &TokenRefresher{DefaultTokenFile: path.Join(dir, "token")}
+		safeWrite(r.DefaultTokenFile, fmt.Sprintf(JwtFmt, base64.RawURLEncoding.EncodeToString([]byte(claims))))
+		return r
+	}
+
+	t.Run("Discover() should fill in unset settings from the pod", func(t *testing.T) {
+		r := setupDiscovery(t, `{"sub":"system:serviceaccount:token-ns:app","aud":["sts.amazonaws.com"],"iat":1000,"exp":87400}`)
+
+		r.Discover()
+
+		if r.Namespace != "pod-ns" {
+			t.Errorf("want namespace pod-ns, got %s", r.Namespace)
+		}
+		if r.ServiceAccount != "app" {
+			t.Errorf("want service account app, got %s", r.ServiceAccount)
+		}
+		if !reflect.DeepEqual(r.TokenAudience, []string{"sts.amazonaws.com"}) {
+			t.Errorf("want audience [sts.amazonaws.com], got %v", r.TokenAudience)
+		}
+		if r.ExpirationDuration != time.Hour*24 {
+			t.Errorf("want expiration 24h, got %v", r.ExpirationDuration)
+		}
+	})
+
+	t.Run("Discover() should not override configured settings", func(t *testing.T) {
+		r := setupDiscovery(t, `{"sub":"system:serviceaccount:token-ns:app","aud":"api","iat":1000,"exp":87400}`)
+		r.Namespace = "ns"
+		r.ServiceAccount = "sa"
+		r.TokenAudience = []string{"aud"}
+		r.ExpirationDuration = time.Hour
+
+		r.Discover()
+
+		if r.Namespace != "ns" || r.ServiceAccount != "sa" || r.TokenAudience[0] != "aud" || r.ExpirationDuration != time.Hour {
+			t.Errorf("Discover() overrode configured settings: %s", r)
+		}
+	})
+
+	t.Run("Discover() should tell if the token has no audience", func(t *testing.T) {
+		r := setupDiscovery(t, `{"sub":"system:serviceaccount:token-ns:app","iat":1000,"exp":87400}`)
+		log := &recordingLogger{}
+		r.Apply(WithLogger(log))
+
+		r.Discover()
+
+		if len(r.TokenAudience) != 0 {
+			t.Errorf("want no audience, got %v", r.TokenAudience)
+		}
+		if !slices.ContainsFunc(log.lines, func(l string) bool { return strings.HasPrefix(l, "No audience found") }) {
+			t.Errorf("want the missing audience logged, got %q", log.lines)
+		}
+	})
+
+	t.Run("Discover() should fall back to the default expiration", func(t *testing.T) {
+		r := setupDiscovery(t, `{"sub":"system:serviceaccount:token-ns:app","aud":"api"}`)
+		namespaceFile = path.Join(t.TempDir(), "missing")
+
+		r.Discover()
+
+		if r.Namespace != "token-ns" {
+			t.Errorf("want namespace token-ns from the sub claim, got %s", r.Namespace)
+		}
+		if !reflect.DeepEqual(r.TokenAudience, []string{"api"}) {
+			t.Errorf("want audience [api], got %v", r.TokenAudience)
+		}
+		if r.ExpirationDuration != 0 || r.expiration() != DefaultExpirationDuration {
+			t.Errorf("want default expiration, got %v", r.expiration())
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package tokenrefresher
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations read by the EKS pod identity webhook to build the projected token
+const (
+	EKSAudienceAnnotation        = "eks.amazonaws.com/audience"
+	EKSTokenExpirationAnnotation = "eks.amazonaws.com/token-expiration"
+)
+
+// importEKSAnnotations adopts the audience and token expiration the EKS pod identity webhook projects
+// for the service account, for those settings which are not configured explicitly.
+func (r *TokenRefresher) importEKSAnnotations(client kubernetes.Interface) error {
+	if len(r.TokenAudience) > 0 && r.ExpirationDuration != 0 {
+		return nil
+	}
+	sa, err := client.CoreV1().ServiceAccounts(r.Namespace).Get(context.TODO(), r.ServiceAccount, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get service account %s/%s: %w", r.Namespace, r.ServiceAccount, err)
+	}
+	if aud, ok := sa.Annotations[EKSAudienceAnnotation]; ok && len(r.TokenAudience) == 0 {
+		r.TokenAudience = []string{strings.TrimSpace(aud)}
+		r.log().Infof("Adopted token audience %v from %s annotation", r.TokenAudience, EKSAudienceAnnotation)
+	}
+	if exp, ok := sa.Annotations[EKSTokenExpirationAnnotation]; ok && r.ExpirationDuration == 0 {
+		sec, err := strconv.ParseInt(strings.TrimSpace(exp), 10, 64)
+		if err != nil || sec <= 0 {
+			return fmt.Errorf("invalid %s annotation: %q", EKSTokenExpirationAnnotation, exp)
+		}
+		r.ExpirationDuration = time.Duration(sec) * time.Second
+		r.log().Infof("Adopted expiration duration %v from %s annotation", r.ExpirationDuration, EKSTokenExpirationAnnotation)
+	}
+	return nil
+}
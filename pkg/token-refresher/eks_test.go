@@ -0,0 +1,72 @@
+package tokenrefresher
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTokenRefresher_importEKSAnnotations(t *testing.T) {
+	serviceAccount := func(annotations map[string]string) *corev1.ServiceAccount {
+		return &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "test-sa", Namespace: "test-ns", Annotations: annotations}}
+	}
+
+	t.Run("importEKSAnnotations() should adopt audience and expiration", func(t *testing.T) {
+		r := &TokenRefresher{Namespace: "test-ns", ServiceAccount: "test-sa"}
+		c := testclient.NewSimpleClientset(serviceAccount(map[string]string{
+			EKSAudienceAnnotation:        "sts.amazonaws.com",
+			EKSTokenExpirationAnnotation: "86400",
+		}))
+
+		if err := r.importEKSAnnotations(c); err != nil {
+			t.Fatalf("importEKSAnnotations() failed: %s", err.Error())
+		}
+		if !reflect.DeepEqual(r.TokenAudience, []string{"sts.amazonaws.com"}) {
+			t.Errorf("want audience [sts.amazonaws.com], got %v", r.TokenAudience)
+		}
+		if r.ExpirationDuration != time.Hour*24 {
+			t.Errorf("want expiration 24h, got %v", r.ExpirationDuration)
+		}
+	})
+
+	t.Run("importEKSAnnotations() should not override configured settings", func(t *testing.T) {
+		r := &TokenRefresher{Namespace: "test-ns", ServiceAccount: "test-sa", ExpirationDuration: time.Hour}
+		c := testclient.NewSimpleClientset(serviceAccount(map[string]string{
+			EKSTokenExpirationAnnotation: "86400",
+		}))
+
+		if err := r.importEKSAnnotations(c); err != nil {
+			t.Fatalf("importEKSAnnotations() failed: %s", err.Error())
+		}
+		if r.ExpirationDuration != time.Hour {
+			t.Errorf("want expiration 1h, got %v", r.ExpirationDuration)
+		}
+		if len(r.TokenAudience) != 0 {
+			t.Errorf("want no audience without annotation, got %v", r.TokenAudience)
+		}
+	})
+
+	t.Run("importEKSAnnotations() should fail on invalid expiration", func(t *testing.T) {
+		r := &TokenRefresher{Namespace: "test-ns", ServiceAccount: "test-sa"}
+		c := testclient.NewSimpleClientset(serviceAccount(map[string]string{
+			EKSTokenExpirationAnnotation: "1d",
+		}))
+
+		if err := r.importEKSAnnotations(c); err == nil {
+			t.Error("importEKSAnnotations() did not fail on invalid expiration")
+		}
+	})
+
+	t.Run("importEKSAnnotations() should fail if the service account cannot be read", func(t *testing.T) {
+		r := &TokenRefresher{Namespace: "test-ns", ServiceAccount: "test-sa"}
+		c := testclient.NewSimpleClientset()
+
+		if err := r.importEKSAnnotations(c); err == nil {
+			t.Error("importEKSAnnotations() did not fail for a missing service account")
+		}
+	})
+}
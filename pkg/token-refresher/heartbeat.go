@@ -0,0 +1,144 @@
+package tokenrefresher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+)
+
+// Heartbeat is a contract with the application to prove it is alive: it touches the heartbeat file
+// or POSTs to /heartbeat on the heartbeat address more often than the window.
+// If it goes stale, no new tokens are minted and the current one is left to expire, which ends the refresh loop.
+type Heartbeat struct {
+	File   string        `mapstructure:"heartbeat_file"`
+	Addr   string        `mapstructure:"heartbeat_addr"`
+	Window time.Duration `mapstructure:"heartbeat_window"`
+
+	mu    sync.Mutex
+	last  time.Time
+	clock Clock
+}
+
+func (h *Heartbeat) enabled() bool {
+	return h.File != "" || h.Addr != ""
+}
+
+func (h *Heartbeat) validate() error {
+	if h.enabled() && h.Window <= 0 {
+		return fmt.Errorf("heartbeat window must be positive, got %v", h.Window)
+	}
+	if h.Addr != "" {
+		return validateLocalAddr("heartbeat", h.Addr)
+	}
+	return nil
+}
+
+// start counts as the first heartbeat, so that the application has a full window to send its own,
+// and serves the heartbeat endpoint if configured until the returned function is called
+func (h *Heartbeat) start(log logger.Logger) (func(), error) {
+	h.beat()
+	if h.Addr == "" {
+		return func() {}, nil
+	}
+	l, err := listenLocal(h.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on heartbeat address %s: %w", h.Addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/heartbeat", h)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("unable to serve heartbeat endpoint on %s: %s", h.Addr, err.Error())
+		}
+	}()
+	log.Infof("Serving heartbeat endpoint on %s", h.Addr)
+	return func() { srv.Close() }, nil
+}
+
+func (h *Heartbeat) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = h.now()
+}
+
+func (h *Heartbeat) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.beat()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lastBeat returns the time of the latest heartbeat from either source.
+// The first check counts as a heartbeat if the heartbeat was not started.
+func (h *Heartbeat) lastBeat() time.Time {
+	h.mu.Lock()
+	if h.last.IsZero() {
+		h.last = h.now()
+	}
+	last := h.last
+	h.mu.Unlock()
+	if h.File != "" {
+		if fi, err := os.Stat(h.File); err == nil && fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last
+}
+
+// stale returns the age of the latest heartbeat and whether it is older than the window
+func (h *Heartbeat) stale(now time.Time) (time.Duration, bool) {
+	age := now.Sub(h.lastBeat())
+	return age, age > h.Window
+}
+
+// checkHeartbeat reports whether the application is alive, alerting once when it goes stale and logging when it recovers
+func (r *TokenRefresher) checkHeartbeat() bool {
+	if !r.Heartbeat.enabled() {
+		return true
+	}
+	age, stale := r.Heartbeat.stale(r.now())
+	if stale && !r.heartbeatStale {
+		r.log().Errorf("ALERT: no heartbeat from the app for %v, which is longer than %v. Not refreshing tokens anymore, the current one is left to expire.",
+			age.Truncate(time.Second), r.Heartbeat.Window)
+	}
+	if !stale && r.heartbeatStale {
+		r.log().Infof("Heartbeat from the app resumed, refreshing tokens again")
+	}
+	r.heartbeatStale = stale
+	return !stale
+}
+
+func (h *Heartbeat) now() time.Time {
+	if h.clock == nil {
+		return time.Now()
+	}
+	return h.clock.Now()
+}
+
+// heartbeatExpired reports once the token which was left to expire because of a stale heartbeat has expired,
+// as the app is not going to get a valid token anymore unless it resumes.
+func (r *TokenRefresher) heartbeatExpired() (ExitReason, bool) {
+	if !r.heartbeatStale {
+		return ExitReason{}, false
+	}
+	b, err := os.ReadFile(r.monitoredTokenFile())
+	if err != nil {
+		return ExitReason{}, false
+	}
+	expiresAt, err := tokenExpiry(string(b))
+	if err != nil || r.now().Before(expiresAt) {
+		return ExitReason{}, false
+	}
+	msg := fmt.Sprintf("Token expired at %s without a heartbeat from the app", expiresAt.Format(time.RFC3339))
+	r.log().Infof("%s", msg)
+	return ExitReason{Kind: ExitHeartbeat, Message: msg}, true
+}
@@ -0,0 +1,114 @@
+package tokenrefresher
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+)
+
+func TestTokenRefresher_checkHeartbeat(t *testing.T) {
+	t.Run("checkHeartbeat() should follow the heartbeat file", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "heartbeat")
+		r := &TokenRefresher{Heartbeat: Heartbeat{File: file, Window: time.Minute}}
+
+		if !r.checkHeartbeat() {
+			t.Errorf("checkHeartbeat() reported a fresh start as stale")
+		}
+		r.Heartbeat.last = time.Now().Add(-2 * time.Minute)
+		if r.checkHeartbeat() {
+			t.Errorf("checkHeartbeat() did not report a missing heartbeat as stale")
+		}
+		safeWrite(file, "")
+		if !r.checkHeartbeat() {
+			t.Errorf("checkHeartbeat() did not pick up the touched file")
+		}
+		old := time.Now().Add(-2 * time.Minute)
+		os.Chtimes(file, old, old)
+		if r.checkHeartbeat() {
+			t.Errorf("checkHeartbeat() did not report a stale file as stale")
+		}
+	})
+
+	t.Run("checkHeartbeat() should follow the heartbeat endpoint", func(t *testing.T) {
+		r := &TokenRefresher{Heartbeat: Heartbeat{Addr: "localhost:0", Window: time.Minute, last: time.Now().Add(-2 * time.Minute)}}
+		if r.checkHeartbeat() {
+			t.Errorf("checkHeartbeat() did not report a missing heartbeat as stale")
+		}
+
+		rec := httptest.NewRecorder()
+		r.Heartbeat.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/heartbeat", nil))
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("want status %d, got %d", http.StatusNoContent, rec.Code)
+		}
+		if !r.checkHeartbeat() {
+			t.Errorf("checkHeartbeat() did not pick up the heartbeat call")
+		}
+	})
+
+	t.Run("refresh loop should not mint tokens while the heartbeat is stale", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		r.Heartbeat = Heartbeat{File: r.TokenFile + ".heartbeat", Window: time.Minute, last: time.Now().Add(-2 * time.Minute)}
+		c := getFakeClient(r, false)
+		done := make(chan struct{})
+
+		go func() {
+			r.refreshLoop(c, nil)
+			close(done)
+		}()
+		time.Sleep(r.RefreshInterval * 2)
+		safeWrite(r.shutdownFile, "")
+		<-done
+
+		if got, _ := os.ReadFile(r.TokenFile); len(got) != 0 {
+			t.Errorf("refreshLoop() refreshed the token despite a stale heartbeat")
+		}
+	})
+}
+
+func TestHeartbeat_start(t *testing.T) {
+	h := &Heartbeat{Addr: "127.0.0.1:0", Window: time.Minute}
+	closeHeartbeat, err := h.start(logger.Std)
+	if err != nil {
+		t.Fatalf("start() failed: %s", err.Error())
+	}
+	closeHeartbeat()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	defer l.Close()
+	h = &Heartbeat{Addr: l.Addr().String(), Window: time.Minute}
+	if _, err := h.start(logger.Std); err == nil {
+		t.Errorf("want an error as the heartbeat address is in use")
+	}
+}
+
+func TestHeartbeat_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       *Heartbeat
+		wantErr bool
+	}{
+		{name: "disabled", h: &Heartbeat{}},
+		{name: "loopback address", h: &Heartbeat{Addr: "localhost:8082", Window: time.Minute}},
+		{name: "unix socket", h: &Heartbeat{Addr: "unix:/tmp/heartbeat.sock", Window: time.Minute}},
+		{name: "pod address", h: &Heartbeat{Addr: ":8082", Window: time.Minute}, wantErr: true},
+		{name: "missing window", h: &Heartbeat{File: "heartbeat"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.h.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package tokenrefresher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks a local address as the path of a Unix socket
+const unixPrefix = "unix:"
+
+// validateLocalAddr only allows local addresses, which cannot be reached from outside the pod:
+// a loopback host:port, e.g. localhost:8083, or unix:<path> for a Unix socket.
+// The http trigger, heartbeat, admin API and token API are only served on them.
+func validateLocalAddr(name, addr string) error {
+	if socket, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if socket == "" {
+			return fmt.Errorf("%s socket path must not be empty", name)
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid %s address %s: %w", name, addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s address %s must be a loopback address or a unix socket", name, addr)
+	}
+	return nil
+}
+
+// listenLocal opens a local address, replacing a stale Unix socket left by a previous run.
+// Anything else at the socket path is left alone.
+func listenLocal(addr string) (net.Listener, error) {
+	if socket, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		fi, err := os.Lstat(socket)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("unable to check socket %s: %w", socket, err)
+		case fi.Mode()&os.ModeSocket == 0:
+			return nil, fmt.Errorf("%s exists and is not a socket", socket)
+		default:
+			if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("unable to remove stale socket %s: %w", socket, err)
+			}
+		}
+		return net.Listen("unix", socket)
+	}
+	return net.Listen("tcp", addr)
+}
+
+type peerUIDKey struct{}
+
+// withPeerUID adds the uid of the peer of a Unix socket to the context of its requests
+func withPeerUID(ctx context.Context, c net.Conn) context.Context {
+	if uid, err := peerUID(c); err == nil {
+		ctx = context.WithValue(ctx, peerUIDKey{}, uid)
+	}
+	return ctx
+}
@@ -0,0 +1,41 @@
+package tokenrefresher
+
+import (
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListenLocal(t *testing.T) {
+	t.Run("listenLocal() should replace a stale socket", func(t *testing.T) {
+		socket := path.Join(t.TempDir(), "api.sock")
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatalf("unable to listen: %s", err.Error())
+		}
+		// leave the socket file behind like a crashed run
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+
+		l, err = listenLocal(unixPrefix + socket)
+		if err != nil {
+			t.Fatalf("listenLocal() failed: %s", err.Error())
+		}
+		l.Close()
+	})
+
+	t.Run("listenLocal() should not remove a regular file", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "token")
+		if err := os.WriteFile(file, []byte("keep"), 0600); err != nil {
+			t.Fatalf("unable to write file: %s", err.Error())
+		}
+
+		if _, err := listenLocal(unixPrefix + file); err == nil {
+			t.Errorf("want an error as %s is not a socket", file)
+		}
+		if b, err := os.ReadFile(file); err != nil || string(b) != "keep" {
+			t.Errorf("want the file kept, got %q, %v", b, err)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package tokenrefresher
+
+import (
+	"slices"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/hooks"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/retry"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Defaults of the settings of a TokenRefresher built by New
+const (
+	DefaultTokenFile        = "/var/run/secrets/token-refresher/token"
+	DefaultProjectedFile    = "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"
+	DefaultRefreshInterval  = time.Hour
+	DefaultShutdownInterval = time.Minute
+	DefaultMaxAttempts      = 3
+	DefaultRetrySleep       = 20 * time.Second
+	DefaultHeartbeatWindow  = 2 * time.Minute
+	DefaultSecretKey        = "token"
+	DefaultHookTimeout      = 10 * time.Second
+	DefaultHookMaxAttempts  = 3
+	DefaultHookSleep        = time.Second
+)
+
+// Clock tells the time the refresher bases its decisions on, e.g. whether a token is about to expire
+// or the termination deadline has passed. Intervals are still measured by real timers.
+type Clock interface {
+	Now() time.Time
+}
+
+// TokenInfo describes a refreshed token
+type TokenInfo struct {
+	Token     string
+	ExpiresAt time.Time
+	Audiences []string
+	// Attempt is the attempt of the refresh which succeeded, starting at 1
+	Attempt int
+}
+
+// ExitKind is why Run returned
+type ExitKind string
+
+const (
+	// ExitStopped is returned once the context passed to Run is done
+	ExitStopped ExitKind = "stopped"
+	// ExitShutdownFile is returned once the application wrote the shutdown files or Stop was called
+	ExitShutdownFile ExitKind = "shutdown_file"
+	// ExitPrimaryContainers is returned once the primary containers terminated
+	ExitPrimaryContainers ExitKind = "primary_containers"
+	// ExitPodDeleted is returned once the pod was deleted while watching the primary containers
+	ExitPodDeleted ExitKind = "pod_deleted"
+	// ExitAppProcess is returned once the app process exited
+	ExitAppProcess ExitKind = "app_process"
+	// ExitHeartbeat is returned once the token left to expire because of a stale heartbeat has expired
+	ExitHeartbeat ExitKind = "heartbeat"
+	// ExitDeadline is returned once the pod's termination deadline has passed
+	ExitDeadline ExitKind = "termination_deadline"
+	// ExitError is returned if the refresher could not be started
+	ExitError ExitKind = "error"
+)
+
+// ExitReason tells why Run returned
+type ExitReason struct {
+	Kind    ExitKind
+	Message string
+}
+
+func (e ExitReason) String() string {
+	if e.Message == "" {
+		return string(e.Kind)
+	}
+	return string(e.Kind) + ": " + e.Message
+}
+
+// callbacks are called synchronously by the refresher, so they must not block
+type callbacks struct {
+	onTrigger  []func(reason string)
+	onRefresh  []func(TokenInfo)
+	onError    []func(error)
+	onShutdown []func(ExitReason)
+}
+
+// Option configures a TokenRefresher
+type Option func(*TokenRefresher)
+
+// New returns a TokenRefresher with the default settings, which can be changed by the options
+// or by setting the exported fields before calling Run
+func New(opts ...Option) *TokenRefresher {
+	r := &TokenRefresher{
+		DefaultTokenFile: DefaultProjectedFile,
+		TokenFile:        DefaultTokenFile,
+		RefreshInterval:  DefaultRefreshInterval,
+		ShutdownInterval: DefaultShutdownInterval,
+		Retryer:          retry.Retryer{MaxAttempts: DefaultMaxAttempts, Sleep: DefaultRetrySleep},
+		Hooks: hooks.Hooks{
+			Timeout:     DefaultHookTimeout,
+			MaxAttempts: DefaultHookMaxAttempts,
+			Sleep:       DefaultHookSleep,
+		},
+		Sinks:     []string{SinkFile},
+		Secret:    SecretSink{SecretKey: DefaultSecretKey},
+		Trigger:   TriggerSettings{Names: DefaultTriggers, Policy: TriggerPolicyAny},
+		Heartbeat: Heartbeat{Window: DefaultHeartbeatWindow},
+	}
+	r.Apply(opts...)
+	return r
+}
+
+// Apply applies options to a refresher whose settings were decoded from a config, before calling Run
+func (r *TokenRefresher) Apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(r)
+	}
+}
+
+// WithClient sets the Kubernetes client instead of creating one from the kubeconfig or the in-cluster config
+func WithClient(client kubernetes.Interface) Option {
+	return func(r *TokenRefresher) {
+		r.client = client
+	}
+}
+
+// WithClock sets the clock, the system clock by default
+func WithClock(clock Clock) Option {
+	return func(r *TokenRefresher) {
+		r.clock = clock
+	}
+}
+
+// WithLogger sets the logger, logger.Std by default
+func WithLogger(l logger.Logger) Option {
+	return func(r *TokenRefresher) {
+		r.logger = l
+	}
+}
+
+// WithTokenSource sets the source refreshed tokens come from instead of the configured one
+func WithTokenSource(src TokenSource) Option {
+	return func(r *TokenRefresher) {
+		r.source = src
+	}
+}
+
+// WithSinks sets the sinks refreshed tokens are written to, see WithSink for custom ones
+func WithSinks(names ...string) Option {
+	return func(r *TokenRefresher) {
+		r.Sinks = names
+	}
+}
+
+// WithSink adds a custom sink under the given name and enables it. The name must not be one of SinkNames.
+func WithSink(name string, s Sink) Option {
+	return func(r *TokenRefresher) {
+		if r.customSinks == nil {
+			r.customSinks = map[string]Sink{}
+		}
+		r.customSinks[name] = s
+		if !slices.Contains(r.Sinks, name) {
+			r.Sinks = append(slices.Clone(r.Sinks), name)
+		}
+	}
+}
+
+// WithTriggers sets the triggers which start refreshing, see WithTrigger for custom ones
+func WithTriggers(policy string, names ...string) Option {
+	return func(r *TokenRefresher) {
+		r.Trigger.Policy = policy
+		r.Trigger.Names = names
+	}
+}
+
+// WithTrigger adds a custom trigger under the given name and enables it. The name must not be one of TriggerNames.
+func WithTrigger(name string, f TriggerFactory) Option {
+	return func(r *TokenRefresher) {
+		if r.customTriggers == nil {
+			r.customTriggers = map[string]TriggerFactory{}
+		}
+		r.customTriggers[name] = f
+		if !slices.Contains(r.Trigger.Names, name) {
+			r.Trigger.Names = append(slices.Clone(r.Trigger.Names), name)
+		}
+	}
+}
+
+// WithSignal sets the channel which fires the signal trigger once it is closed, typically on SIGTERM
+func WithSignal(signal <-chan struct{}) Option {
+	return func(r *TokenRefresher) {
+		r.signal = signal
+	}
+}
+
+// OnTrigger is called with the reason once the refresher enters the active phase
+func OnTrigger(f func(reason string)) Option {
+	return func(r *TokenRefresher) {
+		r.callbacks.onTrigger = append(r.callbacks.onTrigger, f)
+	}
+}
+
+// OnRefresh is called after every successful refresh, once the token was written to the sinks
+func OnRefresh(f func(TokenInfo)) Option {
+	return func(r *TokenRefresher) {
+		r.callbacks.onRefresh = append(r.callbacks.onRefresh, f)
+	}
+}
+
+// OnError is called if a refresh failed after all of its retries, and with the error ending Run
+// if the refresher cannot start, e.g. as it fails to initialize or to set up its triggers
+func OnError(f func(error)) Option {
+	return func(r *TokenRefresher) {
+		r.callbacks.onError = append(r.callbacks.onError, f)
+	}
+}
+
+// OnShutdown is called with the exit reason before Run returns
+func OnShutdown(f func(ExitReason)) Option {
+	return func(r *TokenRefresher) {
+		r.callbacks.onShutdown = append(r.callbacks.onShutdown, f)
+	}
+}
+
+func (r *TokenRefresher) log() logger.Logger {
+	if r.logger == nil {
+		return logger.Std
+	}
+	return r.logger
+}
+
+func (r *TokenRefresher) now() time.Time {
+	if r.clock == nil {
+		return time.Now()
+	}
+	return r.clock.Now()
+}
@@ -0,0 +1,208 @@
+package tokenrefresher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/fakeapiserver"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/retry"
+)
+
+type fixedClock struct{ t time.Time }
+
+func (c fixedClock) Now() time.Time { return c.t }
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.record(format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...interface{})  { l.record(format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.record(format, args...) }
+
+func TestNew(t *testing.T) {
+	r := New(WithSinks(SinkSecret), WithTriggers(TriggerPolicyAll, TriggerFile))
+	if r.TokenFile != DefaultTokenFile || r.RefreshInterval != DefaultRefreshInterval {
+		t.Errorf("want the default settings, got %s", r)
+	}
+	if len(r.Sinks) != 1 || r.Sinks[0] != SinkSecret {
+		t.Errorf("want sinks [%s], got %v", SinkSecret, r.Sinks)
+	}
+	if r.Trigger.Policy != TriggerPolicyAll || len(r.Trigger.Names) != 1 || r.Trigger.Names[0] != TriggerFile {
+		t.Errorf("want triggers all of [%s], got %+v", TriggerFile, r.Trigger)
+	}
+	at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := New(WithClock(fixedClock{at})).now(); !got.Equal(at) {
+		t.Errorf("want the time of the clock %v, got %v", at, got)
+	}
+}
+
+// setupRun returns a refresher built by New with the settings of setup
+func setupRun() (*TokenRefresher, func()) {
+	base, cleanup := setup()
+	r := New()
+	r.DefaultTokenFile, r.TokenFile = base.DefaultTokenFile, base.TokenFile
+	r.ExpirationDuration = base.ExpirationDuration
+	r.RefreshInterval, r.ShutdownInterval = base.RefreshInterval, base.ShutdownInterval
+	r.Namespace, r.ServiceAccount = base.Namespace, base.ServiceAccount
+	return r, cleanup
+}
+
+func TestTokenRefresher_Run(t *testing.T) {
+	t.Run("Run() should stop before being triggered once ctx is done", func(t *testing.T) {
+		r, cleanup := setupRun()
+		defer cleanup()
+		safeWrite(r.DefaultTokenFile, getTokenWithExpiry(time.Hour*2))
+		var shutdown []ExitReason
+		r.Apply(
+			WithClient(getFakeClient(r, false)),
+			WithLogger(&recordingLogger{}),
+			WithTriggers(TriggerPolicyAny, TriggerSignal),
+			OnShutdown(func(reason ExitReason) { shutdown = append(shutdown, reason) }),
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), r.RefreshInterval)
+		defer cancel()
+
+		reason, err := r.Run(ctx)
+		if err != nil {
+			t.Fatalf("Run() failed: %s", err.Error())
+		}
+		if reason.Kind != ExitStopped {
+			t.Errorf("want exit reason %s, got %s", ExitStopped, reason)
+		}
+		if len(shutdown) != 1 || shutdown[0] != reason {
+			t.Errorf("want OnShutdown called with %s, got %v", reason, shutdown)
+		}
+	})
+
+	t.Run("Run() should report refreshes and exit on the shutdown file", func(t *testing.T) {
+		r, cleanup := setupRun()
+		defer cleanup()
+		safeWrite(r.DefaultTokenFile, getTokenWithExpiry(time.Hour*2))
+		signal := make(chan struct{})
+		log := &recordingLogger{}
+		var triggers []string
+		refreshed := make(chan TokenInfo, 10)
+		r.Apply(
+			WithClient(getFakeClient(r, false)),
+			WithLogger(log),
+			WithTriggers(TriggerPolicyAny, TriggerSignal),
+			WithSignal(signal),
+			OnTrigger(func(reason string) { triggers = append(triggers, reason) }),
+			OnRefresh(func(info TokenInfo) { refreshed <- info }),
+		)
+		close(signal)
+
+		go func() {
+			info := <-refreshed
+			if info.Attempt != 1 || time.Until(info.ExpiresAt) <= time.Hour {
+				t.Errorf("unexpected token info %+v", info)
+			}
+			safeWrite(r.shutdownFile, "")
+		}()
+		reason, err := r.Run(context.Background())
+		if err != nil {
+			t.Fatalf("Run() failed: %s", err.Error())
+		}
+		if reason.Kind != ExitShutdownFile {
+			t.Errorf("want exit reason %s, got %s", ExitShutdownFile, reason)
+		}
+		if len(triggers) != 1 || !strings.HasPrefix(triggers[0], TriggerSignal) {
+			t.Errorf("want OnTrigger called with %s, got %v", TriggerSignal, triggers)
+		}
+		if len(log.lines) == 0 {
+			t.Errorf("want logs to be written to the logger")
+		}
+	})
+
+	t.Run("Run() should keep refreshing through a throttling API server", func(t *testing.T) {
+		r, cleanup := setupRun()
+		defer cleanup()
+		srv := fakeapiserver.New(t)
+		srv.Fail(
+			fakeapiserver.Failure{Path: "/token", Status: http.StatusTooManyRequests, RetryAfter: time.Second},
+			fakeapiserver.Failure{Path: "/token", Status: http.StatusServiceUnavailable},
+		)
+		safeWrite(r.DefaultTokenFile, srv.Mint(r.Namespace, r.ServiceAccount, []string{"sts"}, time.Hour*2))
+		r.Retryer.Sleep = 10 * time.Millisecond
+		closed := make(chan struct{})
+		close(closed)
+		var errs []error
+		r.Apply(
+			WithClient(srv.Client()),
+			WithLogger(&recordingLogger{}),
+			WithTriggers(TriggerPolicyAny, TriggerSignal),
+			WithSignal(closed),
+			OnError(func(err error) { errs = append(errs, err) }),
+			OnRefresh(func(TokenInfo) { safeWrite(r.shutdownFile, "") }),
+		)
+
+		reason, err := r.Run(context.Background())
+		if err != nil || reason.Kind != ExitShutdownFile {
+			t.Fatalf("want exit reason %s, got %s, error %v", ExitShutdownFile, reason, err)
+		}
+		token, _ := os.ReadFile(r.TokenFile)
+		if b, _ := os.ReadFile(r.DefaultTokenFile); string(b) == string(token) {
+			t.Fatalf("want a refreshed token instead of the default one")
+		}
+		claims, err := srv.Verify(string(token))
+		if err != nil {
+			t.Fatalf("refreshed token does not verify: %s", err.Error())
+		}
+		if len(claims.Audiences) != 1 || claims.Audiences[0] != "sts" {
+			t.Errorf("want the audience of the default token, got %v", claims.Audiences)
+		}
+		if len(errs) != 0 || srv.Pending() != 0 {
+			t.Errorf("want the failures retried without errors, got %v with %d pending", errs, srv.Pending())
+		}
+	})
+
+	t.Run("Run() should report errors which prevent it from starting", func(t *testing.T) {
+		r, cleanup := setupRun()
+		defer cleanup()
+		var errs []error
+		r.Apply(
+			WithClient(getFakeClient(r, false)),
+			WithLogger(&recordingLogger{}),
+			OnError(func(err error) { errs = append(errs, err) }),
+		)
+
+		reason, err := r.Run(context.Background())
+		if err == nil || reason.Kind != ExitError {
+			t.Fatalf("want exit reason %s without a default token, got %s", ExitError, reason)
+		}
+		if len(errs) != 1 || errs[0] != err {
+			t.Errorf("want OnError called once with the error of Run, got %v", errs)
+		}
+	})
+
+	t.Run("refreshTick() should report refreshes which failed after all retries", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.Retryer = retry.Retryer{MaxAttempts: 2, Sleep: time.Millisecond}
+		var errs []error
+		r.Apply(
+			WithLogger(&recordingLogger{}),
+			OnError(func(err error) { errs = append(errs, err) }),
+		)
+
+		r.refreshTick(getFakeClient(r, true))
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "apiserver overloaded") {
+			t.Errorf("want OnError called once with the error of the refresh, got %v", errs)
+		}
+	})
+}
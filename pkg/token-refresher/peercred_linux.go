@@ -0,0 +1,33 @@
+//go:build linux
+
+package tokenrefresher
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerUID returns the uid of the process on the other end of a Unix socket
+func peerUID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("not a unix socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, fmt.Errorf("unable to read peer credentials: %w", credErr)
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tokenrefresher
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerUID is only supported on Linux, every peer is rejected elsewhere
+func peerUID(net.Conn) (int, error) {
+	return 0, fmt.Errorf("peer credentials are not supported on this platform")
+}
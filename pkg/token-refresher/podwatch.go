@@ -0,0 +1,93 @@
+package tokenrefresher
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podWatchBackoff is how long to wait before re-establishing a failed or closed watch
+var podWatchBackoff = 5 * time.Second
+
+// podDeleted is reported by watchPod once the pod is gone
+const podDeleted = "Pod deletion detected"
+
+// podCheck reports a reason once the pod reached the state being waited for
+type podCheck func(pod *corev1.Pod) (string, bool)
+
+// podTerminating reports once the pod is marked for deletion
+func podTerminating(pod *corev1.Pod) (string, bool) {
+	return "Pod deletionTimestamp detected", pod.DeletionTimestamp != nil
+}
+
+// watchPod watches the refresher's own pod and reports once check is satisfied or the pod is deleted.
+// Only get and watch on the single pod are needed as the watch is restricted to it by a field selector.
+func (r *TokenRefresher) watchPod(client kubernetes.Interface, stopCh <-chan struct{}, check podCheck) <-chan string {
+	ch := make(chan string)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	go func() {
+		defer cancel()
+		for {
+			if msg, ok := r.watchPodOnce(ctx, client, check); ok {
+				select {
+				case ch <- msg:
+				case <-ctx.Done():
+				}
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(podWatchBackoff):
+			}
+		}
+	}()
+	return ch
+}
+
+// watchPodOnce gets the pod and watches it from there until check is satisfied or the watch ends,
+// so that no change is missed between watches.
+func (r *TokenRefresher) watchPodOnce(ctx context.Context, client kubernetes.Interface, check podCheck) (string, bool) {
+	pod, err := client.CoreV1().Pods(r.Namespace).Get(ctx, r.PodName, metav1.GetOptions{})
+	if err != nil {
+		r.log().Warnf("unable to get pod %s/%s: %s", r.Namespace, r.PodName, err.Error())
+		return "", false
+	}
+	if msg, ok := check(pod); ok {
+		return msg, true
+	}
+	w, err := client.CoreV1().Pods(r.Namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", r.PodName).String(),
+		ResourceVersion: pod.ResourceVersion,
+	})
+	if err != nil {
+		r.log().Warnf("unable to watch pod %s/%s: %s", r.Namespace, r.PodName, err.Error())
+		return "", false
+	}
+	defer w.Stop()
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Deleted:
+			return podDeleted, true
+		case watch.Modified:
+			if pod, ok := event.Object.(*corev1.Pod); ok {
+				if msg, ok := check(pod); ok {
+					return msg, true
+				}
+			}
+		case watch.Error:
+			r.log().Warnf("error watching pod %s/%s: %v", r.Namespace, r.PodName, event.Object)
+		}
+	}
+	r.log().Debugf("watch of pod %s/%s closed", r.Namespace, r.PodName)
+	return "", false
+}
@@ -0,0 +1,72 @@
+package tokenrefresher
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTokenRefresher_watchPod(t *testing.T) {
+	t.Run("waitForTrigger() should return when the pod is marked for deletion", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, getTokenWithExpiry(time.Hour*2))
+		r.WatchPod = true
+		r.PodName = "test-pod"
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: r.PodName, Namespace: r.Namespace}}
+		c := testclient.NewSimpleClientset(pod)
+		stopCh := make(chan struct{})
+		retCh := make(chan []string)
+
+		go func() {
+			fired, _ := r.waitForTrigger(context.Background(), c, stopCh)
+			retCh <- fired
+		}()
+
+		select {
+		case <-retCh:
+			t.Fatalf("waitForTrigger() returned pre-maturely while the pod is running")
+		case <-time.After(r.RefreshInterval * 2):
+		}
+		now := metav1.Now()
+		pod.DeletionTimestamp = &now
+		if _, err := c.CoreV1().Pods(r.Namespace).Update(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("unable to update pod: %s", err.Error())
+		}
+		select {
+		case fired := <-retCh:
+			if !reflect.DeepEqual(fired, []string{TriggerPodDeletion}) {
+				t.Errorf("want fired [%s], got %v", TriggerPodDeletion, fired)
+			}
+		case <-time.After(r.RefreshInterval * 2):
+			t.Errorf("waitForTrigger() did not return after the pod was marked for deletion")
+		}
+	})
+
+	t.Run("waitForTrigger() should return immediately if the pod is already terminating", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, getTokenWithExpiry(time.Hour*2))
+		r.WatchPod = true
+		r.PodName = "test-pod"
+		now := metav1.Now()
+		c := testclient.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: r.PodName, Namespace: r.Namespace, DeletionTimestamp: &now}})
+		retCh := make(chan struct{})
+
+		go func() {
+			r.waitForTrigger(context.Background(), c, make(chan struct{}))
+			close(retCh)
+		}()
+
+		select {
+		case <-retCh:
+		case <-time.After(r.RefreshInterval * 2):
+			t.Errorf("waitForTrigger() did not return for a terminating pod")
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package tokenrefresher
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Profile holds the defaults for the token projected by a cloud provider's workload identity integration
+type Profile struct {
+	Name        string
+	Description string
+	// DefaultTokenFileEnv is the env var the provider's webhook injects with the path of the projected token
+	DefaultTokenFileEnv string
+	DefaultTokenFile    string
+	// TokenAudience is left empty if it differs per cluster, so that it is discovered from the default token
+	TokenAudience      []string
+	ExpirationDuration time.Duration
+	RefreshInterval    time.Duration
+}
+
+var profiles = map[string]Profile{
+	"eks-irsa": {
+		Name:                "eks-irsa",
+		Description:         "EKS IAM roles for service accounts",
+		DefaultTokenFileEnv: "AWS_WEB_IDENTITY_TOKEN_FILE",
+		DefaultTokenFile:    "/var/run/secrets/eks.amazonaws.com/serviceaccount/token",
+		TokenAudience:       []string{"sts.amazonaws.com"},
+		ExpirationDuration:  2 * time.Hour,
+		RefreshInterval:     time.Hour,
+	},
+	"eks-pod-identity": {
+		Name:                "eks-pod-identity",
+		Description:         "EKS Pod Identity",
+		DefaultTokenFileEnv: "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+		DefaultTokenFile:    "/var/run/secrets/pods.eks.amazonaws.com/serviceaccount/eks-pod-identity-token",
+		TokenAudience:       []string{"pods.eks.amazonaws.com"},
+		ExpirationDuration:  2 * time.Hour,
+		RefreshInterval:     time.Hour,
+	},
+	"azure": {
+		Name:                "azure",
+		Description:         "Azure Workload Identity",
+		DefaultTokenFileEnv: "AZURE_FEDERATED_TOKEN_FILE",
+		DefaultTokenFile:    "/var/run/secrets/azure/tokens/azure-identity-token",
+		TokenAudience:       []string{"api://AzureADTokenExchange"},
+		ExpirationDuration:  time.Hour,
+		RefreshInterval:     20 * time.Minute,
+	},
+	"gke": {
+		Name:               "gke",
+		Description:        "GKE Workload Identity Federation",
+		DefaultTokenFile:   "/var/run/service-account/token",
+		ExpirationDuration: time.Hour,
+		RefreshInterval:    20 * time.Minute,
+	},
+	"kubernetes": {
+		Name:               "kubernetes",
+		Description:        "plain Kubernetes API tokens",
+		DefaultTokenFile:   "/var/run/secrets/kubernetes.io/serviceaccount/token",
+		ExpirationDuration: time.Hour,
+		RefreshInterval:    20 * time.Minute,
+	},
+}
+
+// GetProfile returns the built-in profile with the given name
+func GetProfile(name string) (Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %s, must be one of %v", name, ProfileNames())
+	}
+	return p, nil
+}
+
+// ProfileNames returns the names of all built-in profiles
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TokenFile returns the path of the projected token, preferring the one injected by the provider's webhook
+func (p Profile) TokenFile() string {
+	if p.DefaultTokenFileEnv != "" {
+		if file := os.Getenv(p.DefaultTokenFileEnv); file != "" {
+			return file
+		}
+	}
+	return p.DefaultTokenFile
+}
@@ -0,0 +1,36 @@
+package tokenrefresher
+
+import (
+	"testing"
+)
+
+func TestProfile_TokenFile(t *testing.T) {
+	p, err := GetProfile("azure")
+	if err != nil {
+		t.Fatalf("GetProfile() failed: %s", err.Error())
+	}
+
+	t.Setenv(p.DefaultTokenFileEnv, "")
+	if got := p.TokenFile(); got != p.DefaultTokenFile {
+		t.Errorf("want %s, got %s", p.DefaultTokenFile, got)
+	}
+	t.Setenv(p.DefaultTokenFileEnv, "/injected/token")
+	if got := p.TokenFile(); got != "/injected/token" {
+		t.Errorf("want /injected/token, got %s", got)
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	for _, name := range ProfileNames() {
+		p, err := GetProfile(name)
+		if err != nil {
+			t.Fatalf("GetProfile(%s) failed: %s", name, err.Error())
+		}
+		if p.ExpirationDuration < MinExpirationDuration || p.ExpirationDuration <= minExpiryFor(p.RefreshInterval) {
+			t.Errorf("profile %s recommends an invalid expiration %v for refresh interval %v", name, p.ExpirationDuration, p.RefreshInterval)
+		}
+	}
+	if _, err := GetProfile("unknown"); err == nil {
+		t.Error("GetProfile() did not fail for an unknown profile")
+	}
+}
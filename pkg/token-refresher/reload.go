@@ -0,0 +1,108 @@
+package tokenrefresher
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/retry"
+)
+
+// Reload applies the settings of c which are safe to change while running: the refresh and shutdown
+// intervals and the retry policy. The new settings are rejected as a whole if they are invalid,
+// leaving the current ones in place. All other settings only take effect on restart.
+func (r *TokenRefresher) Reload(c *TokenRefresher) error {
+	if err := c.validateReloadable(r.expiration()); err != nil {
+		return err
+	}
+	minExpiry := minExpiryFor(c.RefreshInterval)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.RefreshInterval = c.RefreshInterval
+	r.ShutdownInterval = c.ShutdownInterval
+	r.Retryer = c.Retryer
+	r.minExpiryDuration = minExpiry
+	if r.reloaded != nil {
+		close(r.reloaded)
+		r.reloaded = nil
+	}
+	r.log().Infof("Reloaded config: refresh_interval=%v shutdown_interval=%v max_attempts=%d sleep=%v",
+		r.RefreshInterval, r.ShutdownInterval, r.Retryer.MaxAttempts, r.Retryer.Sleep)
+	return nil
+}
+
+// validateReloadable checks the settings which can be changed by Reload against the given token expiration
+func (r *TokenRefresher) validateReloadable(expiration time.Duration) error {
+	if r.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh interval must be positive, got %v", r.RefreshInterval)
+	}
+	if r.ShutdownInterval <= 0 {
+		return fmt.Errorf("shutdown interval must be positive, got %v", r.ShutdownInterval)
+	}
+	if r.Retryer.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1, got %d", r.Retryer.MaxAttempts)
+	}
+	if r.Retryer.Sleep < 0 {
+		return fmt.Errorf("sleep must not be negative, got %v", r.Retryer.Sleep)
+	}
+	if minExpiry := minExpiryFor(r.RefreshInterval); expiration <= minExpiry {
+		return fmt.Errorf("expiration duration %v must be greater than 1.5 * refresh interval (%v)", expiration, minExpiry)
+	}
+	return nil
+}
+
+// minExpiryFor returns how long a token must at least be valid so that it survives until the next refresh
+func minExpiryFor(refreshInterval time.Duration) time.Duration {
+	return refreshInterval + refreshInterval/2
+}
+
+// reloadedCh returns a channel which is closed on the next successful Reload.
+// Callers must keep it until it is closed so that no reload is missed while they are busy.
+func (r *TokenRefresher) reloadedCh() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reloaded == nil {
+		r.reloaded = make(chan struct{})
+	}
+	return r.reloaded
+}
+
+func (r *TokenRefresher) refreshInterval() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.RefreshInterval
+}
+
+func (r *TokenRefresher) shutdownInterval() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ShutdownInterval
+}
+
+func (r *TokenRefresher) retryer() retry.Retryer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Retryer
+}
+
+func (r *TokenRefresher) minExpiry() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.minExpiryDuration
+}
+
+// String prints the exported settings, leaving out the internal state
+func (r *TokenRefresher) String() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v := reflect.ValueOf(r).Elem()
+	fields := make([]string, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.IsExported() {
+			fields = append(fields, fmt.Sprintf("%s:%+v", f.Name, v.Field(i).Interface()))
+		}
+	}
+	return "{" + strings.Join(fields, " ") + "}"
+}
@@ -0,0 +1,62 @@
+package tokenrefresher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/retry"
+)
+
+func TestTokenRefresher_Reload(t *testing.T) {
+	t.Run("Reload() should reject invalid settings and keep the current ones", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		c := &TokenRefresher{
+			RefreshInterval:  time.Hour * 2,
+			ShutdownInterval: time.Second,
+			Retryer:          retry.Retryer{MaxAttempts: 1},
+		}
+
+		if err := r.Reload(c); err == nil {
+			t.Error("Reload() accepted a refresh interval longer than the token expiry")
+		}
+		if r.refreshInterval() != time.Millisecond*200 {
+			t.Errorf("Reload() changed the refresh interval to %v", r.refreshInterval())
+		}
+	})
+
+	t.Run("Reload() should apply new intervals to a running refresh loop", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		r.ShutdownInterval = time.Hour
+		c := getFakeClient(r, false)
+		retCh := make(chan struct{})
+
+		go func() {
+			r.refreshLoop(c, nil)
+			close(retCh)
+		}()
+
+		time.Sleep(r.RefreshInterval)
+		safeWrite(r.shutdownFile, "")
+		select {
+		case <-retCh:
+			t.Fatalf("refreshLoop() returned before the shutdown interval was reloaded")
+		case <-time.After(r.RefreshInterval * 2):
+		}
+		err := r.Reload(&TokenRefresher{
+			RefreshInterval:  r.RefreshInterval,
+			ShutdownInterval: time.Millisecond * 100,
+			Retryer:          retry.Retryer{MaxAttempts: 1},
+		})
+		if err != nil {
+			t.Fatalf("Reload() failed: %s", err.Error())
+		}
+		select {
+		case <-retCh:
+		case <-time.After(time.Second):
+			t.Errorf("refreshLoop() did not pick up the reloaded shutdown interval")
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package tokenrefresher
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	clientretry "k8s.io/client-go/util/retry"
+)
+
+// SecretSink writes the token to a key of a Secret in the namespace of the pod.
+// If the pod name is known, the pod is set as the owner of the Secret so that it is garbage-collected with the pod.
+type SecretSink struct {
+	SecretName string `mapstructure:"secret_name"`
+	SecretKey  string `mapstructure:"secret_key"`
+
+	owner *metav1.OwnerReference
+}
+
+func (s SecretSink) validate() error {
+	if s.SecretName == "" {
+		return fmt.Errorf("secret name is required for the %s sink", SinkSecret)
+	}
+	if s.SecretKey == "" {
+		return fmt.Errorf("secret key is required for the %s sink", SinkSecret)
+	}
+	return nil
+}
+
+func (s *SecretSink) init(client kubernetes.Interface, ns, podName string, log logger.Logger) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if podName == "" {
+		log.Warnf("Pod name not set, secret %s/%s will not be garbage-collected with the pod", ns, s.SecretName)
+		return nil
+	}
+	pod, err := getPod(client, ns, podName)
+	if err != nil {
+		return err
+	}
+	s.owner = &metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       pod.Name,
+		UID:        pod.UID,
+	}
+	return nil
+}
+
+// write creates or updates the Secret. Updates carry the resourceVersion of the Secret they are based on
+// and are retried from a fresh copy on conflicts, as are creates racing with another writer.
+func (s SecretSink) write(ctx context.Context, client kubernetes.Interface, ns, token string) error {
+	secrets := client.CoreV1().Secrets(ns)
+	conflict := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	return clientretry.OnError(clientretry.DefaultRetry, conflict, func() error {
+		secret, err := secrets.Get(ctx, s.SecretName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.SecretName,
+					Namespace: ns,
+				},
+				Type: corev1.SecretTypeOpaque,
+			}
+			s.apply(secret, token)
+			_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		s.apply(secret, token)
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (s SecretSink) apply(secret *corev1.Secret, token string) {
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[s.SecretKey] = []byte(token)
+	if s.owner == nil {
+		return
+	}
+	for _, ref := range secret.OwnerReferences {
+		if ref.UID == s.owner.UID {
+			return
+		}
+	}
+	secret.OwnerReferences = append(secret.OwnerReferences, *s.owner)
+}
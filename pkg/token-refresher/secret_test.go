@@ -0,0 +1,115 @@
+package tokenrefresher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSecretSink_write(t *testing.T) {
+	ns := "test-ns"
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: ns, UID: "test-uid"}}
+
+	t.Run("write() should create the secret owned by the pod", func(t *testing.T) {
+		c := testclient.NewSimpleClientset(pod)
+		s := SecretSink{SecretName: "token", SecretKey: "jwt"}
+		if err := s.init(c, ns, pod.Name, logger.Std); err != nil {
+			t.Fatalf("init() failed: %s", err.Error())
+		}
+
+		if err := s.write(context.Background(), c, ns, "first"); err != nil {
+			t.Fatalf("write() failed: %s", err.Error())
+		}
+
+		secret, err := c.CoreV1().Secrets(ns).Get(context.TODO(), "token", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("secret not created: %s", err.Error())
+		}
+		if string(secret.Data["jwt"]) != "first" {
+			t.Errorf("want: first, got %s", string(secret.Data["jwt"]))
+		}
+		if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != pod.UID {
+			t.Errorf("secret not owned by pod: %+v", secret.OwnerReferences)
+		}
+	})
+
+	t.Run("write() should update the existing secret and keep other keys", func(t *testing.T) {
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: ns, ResourceVersion: "1"},
+			Data:       map[string][]byte{"jwt": []byte("old"), "other": []byte("keep")},
+		}
+		c := testclient.NewSimpleClientset(pod, existing)
+		s := SecretSink{SecretName: "token", SecretKey: "jwt"}
+		if err := s.init(c, ns, pod.Name, logger.Std); err != nil {
+			t.Fatalf("init() failed: %s", err.Error())
+		}
+
+		for _, token := range []string{"first", "second"} {
+			if err := s.write(context.Background(), c, ns, token); err != nil {
+				t.Fatalf("write() failed: %s", err.Error())
+			}
+		}
+
+		secret, err := c.CoreV1().Secrets(ns).Get(context.TODO(), "token", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get secret: %s", err.Error())
+		}
+		if string(secret.Data["jwt"]) != "second" {
+			t.Errorf("want: second, got %s", string(secret.Data["jwt"]))
+		}
+		if string(secret.Data["other"]) != "keep" {
+			t.Errorf("write() dropped other keys of the secret")
+		}
+		if len(secret.OwnerReferences) != 1 {
+			t.Errorf("want 1 owner reference, got %+v", secret.OwnerReferences)
+		}
+	})
+
+	t.Run("write() should update the secret created by another writer meanwhile", func(t *testing.T) {
+		c := testclient.NewSimpleClientset(pod)
+		raced := false
+		c.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if raced {
+				return false, nil, nil
+			}
+			raced = true
+			other := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: ns},
+				Data:       map[string][]byte{"other": []byte("keep")},
+			}
+			if err := c.Tracker().Create(corev1.SchemeGroupVersion.WithResource("secrets"), other, ns); err != nil {
+				return true, nil, err
+			}
+			return true, nil, apierrors.NewAlreadyExists(corev1.Resource("secrets"), "token")
+		})
+		s := SecretSink{SecretName: "token", SecretKey: "jwt"}
+
+		if err := s.write(context.Background(), c, ns, "first"); err != nil {
+			t.Fatalf("write() failed: %s", err.Error())
+		}
+
+		secret, err := c.CoreV1().Secrets(ns).Get(context.TODO(), "token", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get secret: %s", err.Error())
+		}
+		if string(secret.Data["jwt"]) != "first" || string(secret.Data["other"]) != "keep" {
+			t.Errorf("want the token added to the other writer's secret, got %v", secret.Data)
+		}
+	})
+
+	t.Run("init() should fail if the pod does not exist", func(t *testing.T) {
+		c := testclient.NewSimpleClientset()
+		s := SecretSink{SecretName: "token", SecretKey: "jwt"}
+		if err := s.init(c, ns, pod.Name, logger.Std); err == nil {
+			t.Error("init() did not fail for a missing pod")
+		}
+	})
+}
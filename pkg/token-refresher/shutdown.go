@@ -0,0 +1,118 @@
+package tokenrefresher
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ShutdownSettings configure how the application tells the refresher to stop
+type ShutdownSettings struct {
+	// File defaults to ShutdownFile in the directory of the token file
+	File string `mapstructure:"shutdown_file"`
+	// Signalers each write their own done-marker <File>.<name>, refreshing stops once all of them have
+	Signalers []string `mapstructure:"shutdown_signalers"`
+	// Instructions parses the contents of the done-markers, see parseShutdownInstruction
+	Instructions bool `mapstructure:"shutdown_instructions"`
+}
+
+// shutdownPath returns the configured shutdown file, defaulting to the directory of the token file
+func (r *TokenRefresher) shutdownPath() string {
+	if r.Shutdown.File != "" {
+		return r.Shutdown.File
+	}
+	return path.Join(path.Dir(r.TokenFile), ShutdownFile)
+}
+
+// shutdownFiles returns the done-markers which all have to exist before refreshing stops
+func (r *TokenRefresher) shutdownFiles() []string {
+	if len(r.Shutdown.Signalers) == 0 {
+		return []string{r.shutdownFile}
+	}
+	files := make([]string, 0, len(r.Shutdown.Signalers))
+	for _, name := range r.Shutdown.Signalers {
+		files = append(files, r.shutdownFile+"."+name)
+	}
+	return files
+}
+
+// shutdownMarkersPresent reports whether all done-markers exist, regardless of their instructions
+func (r *TokenRefresher) shutdownMarkersPresent() bool {
+	for _, file := range r.shutdownFiles() {
+		if _, err := os.Stat(file); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// shouldShutdown reports whether all done-markers exist and, if their instructions are parsed, all of them say to stop by now
+func (r *TokenRefresher) shouldShutdown() bool {
+	var at time.Time
+	for _, file := range r.shutdownFiles() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return false
+		}
+		if !r.Shutdown.Instructions {
+			continue
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return false
+		}
+		fileAt, err := parseShutdownInstruction(string(b), fi.ModTime())
+		if err != nil {
+			r.log().Errorf("invalid instruction in shutdown file %s, stopping now: %s", file, err.Error())
+			fileAt = fi.ModTime()
+		}
+		if fileAt.After(at) {
+			at = fileAt
+		}
+	}
+	if r.now().Before(at) {
+		if !at.Equal(r.scheduledShutdown) {
+			r.log().Infof("Shutdown scheduled at %s", at.Format(time.RFC3339))
+			r.scheduledShutdown = at
+		}
+		return false
+	}
+	r.log().Infof("Shutdown file detected at %s", strings.Join(r.shutdownFiles(), ", "))
+	return true
+}
+
+// removeShutdownFiles cleans up the done-markers on exit
+func (r *TokenRefresher) removeShutdownFiles() {
+	for _, file := range r.shutdownFiles() {
+		if err := os.Remove(file); err != nil {
+			r.log().Errorf("unable to remove shutdown file: %s", err.Error())
+		}
+	}
+}
+
+// parseShutdownInstruction returns when to stop according to the contents of a done-marker written at the given time:
+// empty or "stop now" stops right away, "stop after <duration>" stops the duration after the marker was written
+// and "stop at <RFC3339 time>" stops at the given time. The "stop" prefix is optional.
+func parseShutdownInstruction(content string, written time.Time) (time.Time, error) {
+	s := strings.TrimSpace(content)
+	s = strings.TrimSpace(strings.TrimPrefix(s, "stop"))
+	switch {
+	case s == "" || s == "now":
+		return written, nil
+	case strings.HasPrefix(s, "after "):
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(s, "after ")))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid duration: %w", err)
+		}
+		return written.Add(d), nil
+	case strings.HasPrefix(s, "at "):
+		at, err := time.Parse(time.RFC3339, strings.TrimSpace(strings.TrimPrefix(s, "at ")))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time: %w", err)
+		}
+		return at, nil
+	}
+	return time.Time{}, fmt.Errorf("unknown instruction %q, must be stop now, stop after <duration> or stop at <RFC3339 time>", strings.TrimSpace(content))
+}
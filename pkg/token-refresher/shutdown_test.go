@@ -0,0 +1,81 @@
+package tokenrefresher
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_parseShutdownInstruction(t *testing.T) {
+	written := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		content string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", written, false},
+		{"stop now\n", written, false},
+		{"now", written, false},
+		{"stop after 5m", written.Add(5 * time.Minute), false},
+		{"after 1h30m", written.Add(90 * time.Minute), false},
+		{"stop at 2024-05-01T13:00:00Z", written.Add(time.Hour), false},
+		{"stop after soon", time.Time{}, true},
+		{"stop at noon", time.Time{}, true},
+		{"please stop", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			got, err := parseShutdownInstruction(tt.content, written)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseShutdownInstruction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTokenRefresher_shouldShutdown(t *testing.T) {
+	t.Run("shouldShutdown() should wait for all signalers", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.Shutdown.Signalers = []string{"app", "worker"}
+
+		safeWrite(r.shutdownFile+".app", "")
+		if r.shouldShutdown() {
+			t.Errorf("shouldShutdown() did not wait for the worker")
+		}
+		safeWrite(r.shutdownFile+".worker", "")
+		if !r.shouldShutdown() {
+			t.Errorf("shouldShutdown() did not stop after all signalers")
+		}
+		r.removeShutdownFiles()
+		if r.shutdownMarkersPresent() {
+			t.Errorf("removeShutdownFiles() did not remove the done-markers")
+		}
+	})
+
+	t.Run("shouldShutdown() should follow the instructions", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.Shutdown.Instructions = true
+
+		safeWrite(r.shutdownFile, "stop after 1h")
+		if r.shouldShutdown() {
+			t.Errorf("shouldShutdown() did not wait for the scheduled time")
+		}
+		safeWrite(r.shutdownFile, "stop at "+time.Now().Add(-time.Minute).Format(time.RFC3339))
+		if !r.shouldShutdown() {
+			t.Errorf("shouldShutdown() did not stop after the scheduled time")
+		}
+		safeWrite(r.shutdownFile, "stop whenever")
+		if !r.shouldShutdown() {
+			t.Errorf("shouldShutdown() did not stop on an invalid instruction")
+		}
+		os.Remove(r.shutdownFile)
+		if r.shouldShutdown() {
+			t.Errorf("shouldShutdown() stopped without a shutdown file")
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package tokenrefresher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/hooks"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/process"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Built-in sinks
+const (
+	SinkFile     = "file"
+	SinkSecret   = "secret"
+	SinkTokenAPI = "token_api"
+	SinkExec     = "exec"
+)
+
+// Sink policies
+const (
+	SinkPolicyAll = "all"
+	SinkPolicyAny = "any"
+)
+
+// DefaultSinkTimeout bounds writing a token to a single sink
+const DefaultSinkTimeout = 30 * time.Second
+
+// Sink delivers a refreshed token, e.g. to a file the application reads
+type Sink interface {
+	Write(ctx context.Context, token string) error
+}
+
+// SinkFunc adapts a function to the Sink interface
+type SinkFunc func(ctx context.Context, token string) error
+
+func (f SinkFunc) Write(ctx context.Context, token string) error {
+	return f(ctx, token)
+}
+
+// sinkEnv is what a built-in sink is built from
+type sinkEnv struct {
+	Refresher *TokenRefresher
+	Client    kubernetes.Interface
+}
+
+// sinkFactory builds a built-in sink. It is called for every refresh, so it should be cheap.
+type sinkFactory func(env sinkEnv) (Sink, error)
+
+// SinkSettings choose how the sinks are written
+type SinkSettings struct {
+	// Policy tells whether a refresh succeeds once all of the sinks or any of them were written
+	Policy string `mapstructure:"sink_policy"`
+	// Command is run in a shell by the exec sink with the token on stdin
+	Command string        `mapstructure:"sink_command"`
+	Timeout time.Duration `mapstructure:"sink_timeout"`
+}
+
+func (s SinkSettings) policy() string {
+	if s.Policy == "" {
+		return SinkPolicyAll
+	}
+	return s.Policy
+}
+
+func (s SinkSettings) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return DefaultSinkTimeout
+	}
+	return s.Timeout
+}
+
+// SinkResult is the outcome of writing a token to a single sink
+type SinkResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// builtinSinks can be enabled by name in the sinks setting. Programs embedding the refresher add their own with WithSink.
+var builtinSinks = map[string]sinkFactory{
+	SinkFile:     newFileSink,
+	SinkSecret:   newSecretSink,
+	SinkTokenAPI: newTokenAPISink,
+	SinkExec:     newExecSink,
+	SinkSTS:      newSTSSink,
+}
+
+// SinkNames returns the names of the built-in sinks
+func SinkNames() []string {
+	names := make([]string, 0, len(builtinSinks))
+	for name := range builtinSinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupSink returns the factory of a sink added by WithSink or of a built-in sink
+func (r *TokenRefresher) lookupSink(name string) (sinkFactory, bool) {
+	if sink, ok := r.customSinks[name]; ok {
+		return func(sinkEnv) (Sink, error) { return sink, nil }, true
+	}
+	f, ok := builtinSinks[name]
+	return f, ok
+}
+
+// sinks returns the configured sinks, defaulting to the token file
+func (r *TokenRefresher) sinks() []string {
+	if len(r.Sinks) == 0 {
+		return []string{SinkFile}
+	}
+	return r.Sinks
+}
+
+func (r *TokenRefresher) hasSink(name string) bool {
+	for _, sink := range r.sinks() {
+		if sink == name {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveredSinks returns the sinks written on every refresh, adding the token API cache if the token API is served
+func (r *TokenRefresher) deliveredSinks() []string {
+	names := r.sinks()
+	if r.tokens != nil && !r.hasSink(SinkTokenAPI) {
+		names = append(names[:len(names):len(names)], SinkTokenAPI)
+	}
+	return names
+}
+
+func (r *TokenRefresher) validateSinks() error {
+	var errs []error
+	if p := r.Sink.policy(); p != SinkPolicyAll && p != SinkPolicyAny {
+		errs = append(errs, fmt.Errorf("unknown sink policy: %s", p))
+	}
+	for _, name := range r.sinks() {
+		if _, ok := r.lookupSink(name); !ok {
+			errs = append(errs, fmt.Errorf("unknown sink: %s", name))
+		}
+	}
+	for name := range r.customSinks {
+		if _, ok := builtinSinks[name]; ok {
+			errs = append(errs, fmt.Errorf("sink %s added by WithSink conflicts with the built-in sink", name))
+		}
+	}
+	if r.hasSink(SinkSecret) {
+		errs = append(errs, r.Secret.validate())
+	}
+	if r.hasSink(SinkTokenAPI) && !r.TokenAPI.enabled() {
+		errs = append(errs, fmt.Errorf("token API address is required for the %s sink", SinkTokenAPI))
+	}
+	if r.hasSink(SinkExec) && r.Sink.Command == "" {
+		errs = append(errs, fmt.Errorf("sink command is required for the %s sink", SinkExec))
+	}
+	if r.hasSink(SinkSTS) {
+		errs = append(errs, r.STS.validate())
+	}
+	return errors.Join(errs...)
+}
+
+// deliveryError is returned if the token was not written to enough sinks to satisfy the sink policy
+type deliveryError struct {
+	results []SinkResult
+	err     error
+}
+
+func (e *deliveryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deliveryError) Unwrap() error {
+	return e.err
+}
+
+// deliver writes the token to every sink, one after the other, and tells how each of them did.
+// Sinks which failed are logged, the returned error is only set if the sink policy is not satisfied.
+// Only the configured sinks count toward the policy, not the token API cache added on top of them.
+func (r *TokenRefresher) deliver(client kubernetes.Interface, token string) ([]SinkResult, error) {
+	names := r.deliveredSinks()
+	configured := len(r.sinks())
+	results := make([]SinkResult, 0, len(names))
+	var errs []error
+	written := 0
+	for i, name := range names {
+		result := SinkResult{Name: name}
+		if err := r.writeSink(client, name, token); err != nil {
+			r.log().Errorf("unable to write token to sink %s: %s", name, err.Error())
+			result.Error = err.Error()
+			errs = append(errs, fmt.Errorf("sink %s: %w", name, err))
+		} else if i < configured {
+			written++
+		}
+		results = append(results, result)
+	}
+	if len(errs) == 0 || (r.Sink.policy() == SinkPolicyAny && written > 0) {
+		return results, nil
+	}
+	return results, &deliveryError{results: results, err: fmt.Errorf("unable to deliver token: %w", errors.Join(errs...))}
+}
+
+func (r *TokenRefresher) writeSink(client kubernetes.Interface, name, token string) error {
+	f, ok := r.lookupSink(name)
+	if !ok {
+		return fmt.Errorf("unknown sink: %s", name)
+	}
+	sink, err := f(sinkEnv{Refresher: r, Client: client})
+	if err != nil {
+		return fmt.Errorf("unable to create sink: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.Sink.timeout())
+	defer cancel()
+	return sink.Write(ctx, token)
+}
+
+func newFileSink(env sinkEnv) (Sink, error) {
+	file := env.Refresher.TokenFile
+	return SinkFunc(func(_ context.Context, token string) error {
+		return safeWrite(file, token)
+	}), nil
+}
+
+func newSecretSink(env sinkEnv) (Sink, error) {
+	r := env.Refresher
+	return SinkFunc(func(ctx context.Context, token string) error {
+		if err := r.Secret.write(ctx, env.Client, r.Namespace, token); err != nil {
+			return fmt.Errorf("unable to write secret %s/%s: %w", r.Namespace, r.Secret.SecretName, err)
+		}
+		return nil
+	}), nil
+}
+
+// newTokenAPISink updates the token served by the token API, it does nothing if the token API is disabled
+func newTokenAPISink(env sinkEnv) (Sink, error) {
+	tokens := env.Refresher.tokens
+	return SinkFunc(func(_ context.Context, token string) error {
+		if tokens != nil {
+			tokens.set(token)
+		}
+		return nil
+	}), nil
+}
+
+// newExecSink runs the sink command with the token on stdin and its expiry in the environment.
+// The output is only logged at debug level, as a command echoing its input would leak the token.
+func newExecSink(env sinkEnv) (Sink, error) {
+	command := env.Refresher.Sink.Command
+	log := env.Refresher.log()
+	return SinkFunc(func(ctx context.Context, token string) error {
+		expiresAt, err := tokenExpiry(token)
+		if err != nil {
+			return fmt.Errorf("unable to read token expiry: %w", err)
+		}
+		cmd := process.ShellCommand(ctx, command, hooks.EnvExpiresAt+"="+expiresAt.Format(time.RFC3339))
+		cmd.Stdin = strings.NewReader(token)
+		out, err := cmd.CombinedOutput()
+		if len(out) > 0 {
+			log.Debugf("Sink exec output: %s", strings.TrimSpace(string(out)))
+		}
+		if err != nil {
+			return fmt.Errorf("unable to run %q: %w", command, err)
+		}
+		return nil
+	}), nil
+}
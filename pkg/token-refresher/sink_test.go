@@ -0,0 +1,168 @@
+package tokenrefresher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const sinkFailing = "test_failing"
+
+var failingSink = SinkFunc(func(context.Context, string) error {
+	return errors.New("sink unavailable")
+})
+
+// withFailingSink adds the failing sink, the sinks are set by the caller
+func withFailingSink(r *TokenRefresher, sinks ...string) {
+	r.Apply(WithSink(sinkFailing, failingSink))
+	r.Sinks = sinks
+}
+
+func TestWithSink(t *testing.T) {
+	if r := New(WithSink(sinkFailing, failingSink)); !reflect.DeepEqual(r.Sinks, []string{SinkFile, sinkFailing}) {
+		t.Errorf("want the sink enabled next to the default one, got %v", r.Sinks)
+	}
+	if r := New(WithSinks(sinkFailing), WithSink(sinkFailing, failingSink)); !reflect.DeepEqual(r.Sinks, []string{sinkFailing}) {
+		t.Errorf("want the sink enabled once, got %v", r.Sinks)
+	}
+	if r := New(); r.customSinks != nil {
+		t.Errorf("want sinks added to one refresher only")
+	}
+}
+
+func TestTokenRefresher_validateSinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(r *TokenRefresher)
+		wantErr bool
+	}{
+		{"Accept the default sink", func(r *TokenRefresher) {}, false},
+		{"Accept sinks added by WithSink", func(r *TokenRefresher) { withFailingSink(r, SinkFile, sinkFailing) }, false},
+		{"Reject sink added by WithSink shadowing a built-in one", func(r *TokenRefresher) { r.Apply(WithSink(SinkFile, failingSink)) }, true},
+		{"Reject unknown sink", func(r *TokenRefresher) { r.Sinks = []string{"nowhere"} }, true},
+		{"Reject unknown policy", func(r *TokenRefresher) { r.Sink.Policy = "most" }, true},
+		{"Reject exec sink without command", func(r *TokenRefresher) { r.Sinks = []string{SinkExec} }, true},
+		{"Reject token API sink without token API", func(r *TokenRefresher) { r.Sinks = []string{SinkTokenAPI} }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &TokenRefresher{}
+			tt.modify(r)
+			if err := r.validateSinks(); (err != nil) != tt.wantErr {
+				t.Errorf("validateSinks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenRefresher_deliver(t *testing.T) {
+	t.Run("deliver() should fail with the all policy if a sink fails", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		withFailingSink(r, SinkFile, sinkFailing)
+		token := getTokenWithExpiry(time.Hour)
+
+		results, err := r.deliver(nil, token)
+		if err == nil {
+			t.Fatalf("want an error as %s failed", sinkFailing)
+		}
+		if len(results) != 2 || results[0].Error != "" || results[1].Error == "" {
+			t.Errorf("want the result of every sink, got %+v", results)
+		}
+		if got, _ := os.ReadFile(r.TokenFile); string(got) != token {
+			t.Errorf("want the token written to the other sinks anyway")
+		}
+	})
+
+	t.Run("deliver() should succeed with the any policy if a sink was written", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		withFailingSink(r, sinkFailing, SinkFile)
+		r.Sink.Policy = SinkPolicyAny
+
+		if _, err := r.deliver(nil, getTokenWithExpiry(time.Hour)); err != nil {
+			t.Errorf("deliver() failed: %s", err.Error())
+		}
+		withFailingSink(r, sinkFailing)
+		if _, err := r.deliver(nil, getTokenWithExpiry(time.Hour)); err == nil {
+			t.Errorf("want an error as no sink was written")
+		}
+	})
+
+	t.Run("deliver() should update the token API if it is served", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.tokens = newTokenCache()
+		token := getTokenWithExpiry(time.Hour)
+
+		results, err := r.deliver(nil, token)
+		if err != nil {
+			t.Fatalf("deliver() failed: %s", err.Error())
+		}
+		if len(results) != 2 || results[1].Name != SinkTokenAPI {
+			t.Errorf("want the token API added to the sinks, got %+v", results)
+		}
+		if got, _ := r.tokens.get(); got != token {
+			t.Errorf("want the token served by the token API")
+		}
+	})
+
+	t.Run("deliver() should not count the token API toward the any policy", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.tokens = newTokenCache()
+		withFailingSink(r, sinkFailing)
+		r.Sink.Policy = SinkPolicyAny
+
+		if _, err := r.deliver(nil, getTokenWithExpiry(time.Hour)); err == nil {
+			t.Errorf("want an error as no configured sink was written")
+		}
+	})
+
+	t.Run("exec sink should get the token on stdin", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		out := path.Join(t.TempDir(), "out")
+		r.Sinks = []string{SinkExec}
+		r.Sink.Command = `cat > ` + out + ` && test -n "$TOKEN_REFRESHER_EXPIRES_AT"`
+		token := getTokenWithExpiry(time.Hour)
+
+		if _, err := r.deliver(nil, token); err != nil {
+			t.Fatalf("deliver() failed: %s", err.Error())
+		}
+		if got, _ := os.ReadFile(out); string(got) != token {
+			t.Errorf("want the token on stdin, got %q", got)
+		}
+	})
+
+	t.Run("exec sink should not run without the expiry of the token", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		out := path.Join(t.TempDir(), "out")
+		r.Sinks = []string{SinkExec}
+		r.Sink.Command = `cat > ` + out
+
+		if _, err := r.deliver(nil, "not-a-jwt"); err == nil {
+			t.Errorf("want an error as the token has no expiry")
+		}
+		if _, err := os.Stat(out); err == nil {
+			t.Errorf("want the command not run")
+		}
+	})
+
+	t.Run("refreshTick() should record the results of the sinks of a failed refresh", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		withFailingSink(r, SinkFile, sinkFailing)
+
+		r.refreshTick(getFakeClient(r, false))
+		last := r.State().LastRefresh
+		if last == nil || last.Error == "" || len(last.Sinks) != 2 {
+			t.Errorf("want a failed refresh with the results of the sinks, got %+v", last)
+		}
+	})
+}
@@ -0,0 +1,252 @@
+package tokenrefresher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/process"
+
+	v1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Built-in token sources
+const (
+	SourceTokenRequest = "token_request"
+	SourceFile         = "file"
+	SourceExec         = "exec"
+	SourceHTTP         = "http"
+)
+
+// Env vars passed on to the exec source
+const (
+	EnvAudiences         = "TOKEN_REFRESHER_AUDIENCES"
+	EnvExpirationSeconds = "TOKEN_REFRESHER_EXPIRATION_SECONDS"
+)
+
+// DefaultSourceTimeout bounds a single attempt to get a token from the source
+const DefaultSourceTimeout = 30 * time.Second
+
+// maxTokenSize bounds what is read from the exec and http sources
+const maxTokenSize = 1 << 20
+
+// TokenRequest describes the token a refresh asks for
+type TokenRequest struct {
+	// Audiences of the token, the configured ones unless minted on demand for others
+	Audiences []string
+	// Expiration is how long the token should be valid, already cut to the termination deadline
+	Expiration time.Duration
+}
+
+// TokenSource creates the tokens the refresher keeps alive. Every token it returns is checked for its expiry
+// before being written to the sinks, so it has to be a JWT with an `exp` claim.
+type TokenSource interface {
+	Token(ctx context.Context, req TokenRequest) (string, error)
+}
+
+// TokenSourceFunc adapts a function to the TokenSource interface
+type TokenSourceFunc func(ctx context.Context, req TokenRequest) (string, error)
+
+func (f TokenSourceFunc) Token(ctx context.Context, req TokenRequest) (string, error) {
+	return f(ctx, req)
+}
+
+// SourceSettings choose where tokens come from, the TokenRequest API of the service account by default
+type SourceSettings struct {
+	Name string `mapstructure:"source"`
+	// File is read by the file source, typically another projected token which the kubelet rotates
+	File string `mapstructure:"source_file"`
+	// Command is run in a shell by the exec source and prints the token on stdout
+	Command string `mapstructure:"source_command"`
+	// URL is fetched by the http source
+	URL     string        `mapstructure:"source_url"`
+	Timeout time.Duration `mapstructure:"source_timeout"`
+}
+
+func (s SourceSettings) name() string {
+	if s.Name == "" {
+		return SourceTokenRequest
+	}
+	return s.Name
+}
+
+func (s SourceSettings) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return DefaultSourceTimeout
+	}
+	return s.Timeout
+}
+
+func (s SourceSettings) validate() error {
+	switch s.name() {
+	case SourceTokenRequest:
+	case SourceFile:
+		if s.File == "" {
+			return fmt.Errorf("source file is required for the %s source", SourceFile)
+		}
+	case SourceExec:
+		if s.Command == "" {
+			return fmt.Errorf("source command is required for the %s source", SourceExec)
+		}
+	case SourceHTTP:
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("source url %q must be an absolute http or https url", s.URL)
+		}
+	default:
+		return fmt.Errorf("unknown source: %s", s.Name)
+	}
+	return nil
+}
+
+// tokenSource returns the source given by WithTokenSource or the configured one
+func (r *TokenRefresher) tokenSource(client kubernetes.Interface) (TokenSource, error) {
+	if r.source != nil {
+		return r.source, nil
+	}
+	switch r.Source.name() {
+	case SourceTokenRequest:
+		return tokenRequestSource{client: client, ns: r.Namespace, sa: r.ServiceAccount}, nil
+	case SourceFile:
+		return fileSource{file: r.Source.File}, nil
+	case SourceExec:
+		return execSource{command: r.Source.Command, log: r.log()}, nil
+	case SourceHTTP:
+		return httpSource{url: r.Source.URL}, nil
+	}
+	return nil, fmt.Errorf("unknown source: %s", r.Source.Name)
+}
+
+// mintsAudiences tells whether the source can create tokens for other audiences than the configured ones
+func (r *TokenRefresher) mintsAudiences() bool {
+	return r.source != nil || r.Source.name() != SourceFile
+}
+
+// createToken gets a token from the source, bounded by the source timeout
+func (r *TokenRefresher) createToken(client kubernetes.Interface, audiences []string, expiration time.Duration) (string, error) {
+	src, err := r.tokenSource(client)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.Source.timeout())
+	defer cancel()
+	token, err := src.Token(ctx, TokenRequest{Audiences: audiences, Expiration: expiration})
+	if err != nil {
+		return "", fmt.Errorf("unable to create token: %w", err)
+	}
+	return token, nil
+}
+
+// tokenRequestSource creates tokens of the service account with the TokenRequest API
+type tokenRequestSource struct {
+	client kubernetes.Interface
+	ns, sa string
+}
+
+func (s tokenRequestSource) Token(ctx context.Context, req TokenRequest) (string, error) {
+	expSec := req.Expiration.Milliseconds() / 1000
+	tr := &v1.TokenRequest{
+		Spec: v1.TokenRequestSpec{
+			Audiences:         req.Audiences,
+			ExpirationSeconds: &expSec,
+		},
+	}
+	resp, err := createToken(ctx, s.client, s.ns, s.sa, tr)
+	if err != nil {
+		return "", err
+	}
+	return resp.Status.Token, nil
+}
+
+// fileSource reads the token from a file. Audiences and expiration are fixed by whoever writes the file.
+type fileSource struct {
+	file string
+}
+
+func (s fileSource) Token(context.Context, TokenRequest) (string, error) {
+	b, err := os.ReadFile(s.file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read file %s: %w", s.file, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// execSource runs a command in a shell which prints the token on stdout, like a credential plugin
+type execSource struct {
+	command string
+	log     logger.Logger
+}
+
+func (s execSource) Token(ctx context.Context, req TokenRequest) (string, error) {
+	cmd := process.ShellCommand(ctx, s.command,
+		EnvAudiences+"="+strings.Join(req.Audiences, ","),
+		EnvExpirationSeconds+"="+strconv.FormatInt(int64(req.Expiration.Seconds()), 10),
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if stderr.Len() > 0 {
+		s.log.Infof("Source exec output: %s", strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to run %q: %w", s.command, err)
+	}
+	if stdout.Len() > maxTokenSize {
+		return "", fmt.Errorf("output of %q exceeds %d bytes", s.command, maxTokenSize)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// httpSource gets the token from an endpoint, passing the audiences and expiration as query parameters.
+// The response is either the plain token or json with a token field, like the token API serves.
+type httpSource struct {
+	url string
+}
+
+func (s httpSource) Token(ctx context.Context, req TokenRequest) (string, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse url %s: %w", s.url, err)
+	}
+	q := u.Query()
+	if len(req.Audiences) > 0 {
+		q.Set("audience", strings.Join(req.Audiences, ","))
+	}
+	q.Set("expiration_seconds", strconv.FormatInt(int64(req.Expiration.Seconds()), 10))
+	u.RawQuery = q.Encode()
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return "", fmt.Errorf("unable to get token from %s: %w", u.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenSize))
+	if err != nil {
+		return "", fmt.Errorf("unable to read token from %s: %w", u.Redacted(), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status from %s: %s", u.Redacted(), resp.Status)
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct != "application/json" {
+		return strings.TrimSpace(string(body)), nil
+	}
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", fmt.Errorf("unable to decode token from %s: %w", u.Redacted(), err)
+	}
+	return tr.Token, nil
+}
@@ -0,0 +1,188 @@
+package tokenrefresher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+)
+
+func TestSourceSettings_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  SourceSettings
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "file", source: SourceSettings{Name: SourceFile, File: "/var/run/token"}},
+		{name: "file without path", source: SourceSettings{Name: SourceFile}, wantErr: true},
+		{name: "exec", source: SourceSettings{Name: SourceExec, Command: "cat /token"}},
+		{name: "exec without command", source: SourceSettings{Name: SourceExec}, wantErr: true},
+		{name: "http", source: SourceSettings{Name: SourceHTTP, URL: "http://localhost:8084/token"}},
+		{name: "http with relative url", source: SourceSettings{Name: SourceHTTP, URL: "/token"}, wantErr: true},
+		{name: "unknown", source: SourceSettings{Name: "vault"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.source.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	req := TokenRequest{Audiences: []string{"vault", "sts"}, Expiration: time.Hour}
+
+	t.Run("file source should read the token file", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "token")
+		token := getTokenWithExpiry(time.Hour)
+		safeWrite(file, token+"\n")
+
+		got, err := fileSource{file: file}.Token(context.Background(), req)
+		if err != nil || got != token {
+			t.Errorf("want the token of the file, got %q, error %v", got, err)
+		}
+	})
+
+	t.Run("exec source should return stdout of the command", func(t *testing.T) {
+		s := execSource{command: `echo "$TOKEN_REFRESHER_AUDIENCES/$TOKEN_REFRESHER_EXPIRATION_SECONDS"; echo ignored >&2`, log: logger.Std}
+
+		got, err := s.Token(context.Background(), req)
+		if err != nil || got != "vault,sts/3600" {
+			t.Errorf("want the audiences and expiration as output, got %q, error %v", got, err)
+		}
+	})
+
+	t.Run("exec source should fail if the command fails", func(t *testing.T) {
+		s := execSource{command: "exit 1", log: logger.Std}
+		if _, err := s.Token(context.Background(), req); err == nil {
+			t.Errorf("want an error of the failing command")
+		}
+	})
+
+	t.Run("exec source should be killed on timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if _, err := (execSource{command: "sleep 10", log: logger.Std}).Token(ctx, req); err == nil {
+			t.Errorf("want an error of the killed command")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("command was not killed on timeout, took %v", d)
+		}
+	})
+
+	t.Run("http source should pass the request as query parameters", func(t *testing.T) {
+		for _, contentType := range []string{"text/plain", "application/json; charset=utf-8"} {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				token := r.URL.Query().Get("audience") + "/" + r.URL.Query().Get("expiration_seconds")
+				w.Header().Set("Content-Type", contentType)
+				if contentType == "text/plain" {
+					fmt.Fprintln(w, token)
+					return
+				}
+				fmt.Fprintf(w, `{"token": %q}`, token)
+			}))
+
+			got, err := httpSource{url: srv.URL + "/token"}.Token(context.Background(), req)
+			if err != nil || got != "vault,sts/3600" {
+				t.Errorf("%s: want the audiences and expiration as token, got %q, error %v", contentType, got, err)
+			}
+			srv.Close()
+		}
+	})
+
+	t.Run("http source should fail on unexpected status", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+
+		if _, err := (httpSource{url: srv.URL}).Token(context.Background(), req); err == nil {
+			t.Errorf("want an error on status 503")
+		}
+	})
+}
+
+func TestTokenRefresher_tokenSource(t *testing.T) {
+	t.Run("refresh() should write the token of the configured source", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		token := getTokenWithExpiry(time.Hour * 2)
+		r.Source = SourceSettings{Name: SourceFile, File: r.DefaultTokenFile}
+		safeWrite(r.DefaultTokenFile, token)
+
+		if err := r.refresh(nil); err != nil {
+			t.Fatalf("refresh() failed: %s", err.Error())
+		}
+		if got, _ := os.ReadFile(r.TokenFile); string(got) != token {
+			t.Errorf("want the token of the source file")
+		}
+	})
+
+	t.Run("Init() should not need Kubernetes for the file source", func(t *testing.T) {
+		r, cleanup := setupRun()
+		defer cleanup()
+		safeWrite(r.DefaultTokenFile, getTokenWithExpiry(time.Hour*2))
+		r.Namespace, r.ServiceAccount = "", ""
+		r.KubeConfig = path.Join(t.TempDir(), "missing")
+		r.Source = SourceSettings{Name: SourceFile, File: r.DefaultTokenFile}
+		r.Apply(WithLogger(&recordingLogger{}))
+
+		if err := r.Init(); err != nil {
+			t.Fatalf("Init() failed: %s", err.Error())
+		}
+		if r.client != nil {
+			t.Errorf("want no Kubernetes client for the %s source", SourceFile)
+		}
+	})
+
+	t.Run("refresh() should reject tokens which expire too soon", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.Apply(WithTokenSource(TokenSourceFunc(func(context.Context, TokenRequest) (string, error) {
+			return getTokenWithExpiry(time.Minute), nil
+		})))
+
+		if err := r.refresh(nil); err == nil {
+			t.Errorf("want an error for a token which expires too soon")
+		}
+	})
+
+	t.Run("refresh() should pass the audiences and expiration to a custom source", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.TokenAudience = []string{"sts.amazonaws.com"}
+		var got TokenRequest
+		r.Apply(WithTokenSource(TokenSourceFunc(func(_ context.Context, req TokenRequest) (string, error) {
+			got = req
+			return getTokenWithExpiry(req.Expiration), nil
+		})))
+
+		if err := r.refresh(nil); err != nil {
+			t.Fatalf("refresh() failed: %s", err.Error())
+		}
+		if len(got.Audiences) != 1 || got.Audiences[0] != "sts.amazonaws.com" || got.Expiration != r.ExpirationDuration {
+			t.Errorf("unexpected token request %+v", got)
+		}
+	})
+
+	t.Run("GET /token should not mint other audiences from the file source", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.Source = SourceSettings{Name: SourceFile, File: r.DefaultTokenFile}
+		r.TokenAPI.Audiences = []string{"vault"}
+		r.tokens = newTokenCache()
+
+		if code, _ := getToken(t, r.tokenAPIHandler(nil), "/token?audience=vault"); code != http.StatusBadRequest {
+			t.Errorf("want status 400, got %d", code)
+		}
+	})
+}
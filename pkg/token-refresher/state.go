@@ -0,0 +1,174 @@
+package tokenrefresher
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Phases of the refresher
+const (
+	PhaseInitializing = "initializing"
+	PhasePassive      = "passive"
+	PhaseActive       = "active"
+	PhaseStopped      = "stopped"
+)
+
+// TriggerManual is recorded as the trigger if the active phase was entered by ForceRefresh or Activate
+const TriggerManual = "manual"
+
+// RefreshResult is the outcome of the latest refresh, including all of its retries
+type RefreshResult struct {
+	Time      time.Time `json:"time"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// Sinks tell how writing the token to each sink went, if the token got that far
+	Sinks []SinkResult `json:"sinks,omitempty"`
+}
+
+// State is a snapshot of what the refresher is doing, for troubleshooting
+type State struct {
+	Phase         string                 `json:"phase"`
+	TriggerReason string                 `json:"trigger_reason,omitempty"`
+	TokenFile     string                 `json:"token_file"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+	ClaimsError   string                 `json:"claims_error,omitempty"`
+	LastRefresh   *RefreshResult         `json:"last_refresh,omitempty"`
+	NextRefresh   *time.Time             `json:"next_refresh,omitempty"`
+	// RetryAttempt is the attempt of the refresh in progress, 0 if none is in progress
+	RetryAttempt int        `json:"retry_attempt"`
+	MaxAttempts  int        `json:"max_attempts"`
+	RetrySleep   string     `json:"retry_sleep"`
+	Deadline     *time.Time `json:"termination_deadline,omitempty"`
+}
+
+// State returns a snapshot of the refresher, including the claims of the token the application currently uses
+func (r *TokenRefresher) State() State {
+	r.mu.RLock()
+	s := State{
+		Phase:         r.phase,
+		TriggerReason: r.triggerReason,
+		TokenFile:     r.monitoredTokenFile(),
+		RetryAttempt:  r.retryAttempt,
+		MaxAttempts:   r.Retryer.MaxAttempts,
+		RetrySleep:    r.Retryer.Sleep.String(),
+	}
+	if r.lastRefresh != nil {
+		last := *r.lastRefresh
+		s.LastRefresh = &last
+	}
+	if !r.nextRefresh.IsZero() {
+		next := r.nextRefresh
+		s.NextRefresh = &next
+	}
+	if !r.deadline.IsZero() {
+		deadline := r.deadline
+		s.Deadline = &deadline
+	}
+	r.mu.RUnlock()
+	if s.Phase == "" {
+		s.Phase = PhaseInitializing
+	}
+
+	b, err := os.ReadFile(s.TokenFile)
+	if err == nil {
+		s.Claims, err = parseClaims(string(b))
+	}
+	if err != nil {
+		s.ClaimsError = err.Error()
+	}
+	return s
+}
+
+func (r *TokenRefresher) setPhase(phase string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if phase != r.phase && r.activate != nil {
+		// an activation accepted while the passive phase ended must not fire in a later one
+		select {
+		case <-r.activate:
+		default:
+		}
+	}
+	r.phase = phase
+	r.log().Debugf("entering %s phase", phase)
+}
+
+func (r *TokenRefresher) setNextRefresh(next time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextRefresh = next
+}
+
+func (r *TokenRefresher) setRetryAttempt(attempt int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retryAttempt = attempt
+}
+
+func (r *TokenRefresher) setLastRefresh(result RefreshResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastRefresh = &result
+}
+
+// ForceRefresh requests an immediate refresh, entering the active phase if the refresher is still passive.
+// Requests made while one is pending are merged.
+func (r *TokenRefresher) ForceRefresh() {
+	select {
+	case r.forceCh() <- struct{}{}:
+		r.log().Infof("Forced refresh requested")
+	default:
+		r.log().Infof("Forced refresh already pending")
+	}
+}
+
+func (r *TokenRefresher) forceCh() chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.force == nil {
+		r.force = make(chan struct{}, 1)
+	}
+	return r.force
+}
+
+// Activate enters the active phase regardless of the trigger policy. It fails unless the refresher is passive.
+func (r *TokenRefresher) Activate(reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.phase != PhasePassive {
+		return fmt.Errorf("refresher is %s, not %s", r.phase, PhasePassive)
+	}
+	select {
+	case r.activateChLocked() <- reason:
+		r.log().Infof("Activation requested: %s", reason)
+	default:
+		r.log().Infof("Activation already pending")
+	}
+	return nil
+}
+
+func (r *TokenRefresher) activateCh() chan string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.activateChLocked()
+}
+
+// activateChLocked must be called with mu held
+func (r *TokenRefresher) activateChLocked() chan string {
+	if r.activate == nil {
+		r.activate = make(chan string, 1)
+	}
+	return r.activate
+}
+
+// Stop writes the shutdown files on behalf of every signaler, as if the application had written them
+func (r *TokenRefresher) Stop() error {
+	for _, file := range r.shutdownFiles() {
+		if err := safeWrite(file, ""); err != nil {
+			return fmt.Errorf("unable to write shutdown file %s: %w", file, err)
+		}
+	}
+	r.log().Infof("Stop requested")
+	return nil
+}
@@ -0,0 +1,102 @@
+package tokenrefresher
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTokenRefresher_ForceRefresh(t *testing.T) {
+	t.Run("ForceRefresh() should end the passive phase", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, getTokenWithExpiry(time.Hour*2))
+		retCh := make(chan []string)
+
+		go func() {
+			fired, _ := r.waitForTrigger(context.Background(), nil, make(chan struct{}))
+			retCh <- fired
+		}()
+
+		r.ForceRefresh()
+		select {
+		case fired := <-retCh:
+			if len(fired) != 1 || fired[0] != TriggerManual {
+				t.Errorf("want trigger %s, got %v", TriggerManual, fired)
+			}
+		case <-time.After(r.RefreshInterval * 2):
+			t.Errorf("waitForTrigger() did not return on ForceRefresh()")
+		}
+	})
+
+	t.Run("ForceRefresh() should refresh right away in the active phase", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		r.RefreshInterval = time.Hour
+		c := getFakeClient(r, false)
+		stop := make(chan struct{})
+		done := make(chan struct{})
+
+		go func() {
+			r.refreshLoop(c, stop)
+			close(done)
+		}()
+		// the first refresh happens on start, wait for it before emptying the token file
+		for r.State().LastRefresh == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		safeWrite(r.TokenFile, "")
+		r.ForceRefresh()
+		time.Sleep(r.ShutdownInterval)
+		close(stop)
+		<-done
+
+		if got, _ := os.ReadFile(r.TokenFile); len(got) == 0 {
+			t.Errorf("ForceRefresh() did not refresh the token")
+		}
+	})
+}
+
+func TestTokenRefresher_Activate(t *testing.T) {
+	r := &TokenRefresher{}
+	if err := r.Activate("too early"); err == nil {
+		t.Errorf("want an error before the passive phase")
+	}
+	r.setPhase(PhasePassive)
+	if err := r.Activate("test"); err != nil {
+		t.Fatalf("Activate() failed: %s", err.Error())
+	}
+	// a trigger fired meanwhile
+	r.setPhase(PhaseActive)
+	select {
+	case reason := <-r.activateCh():
+		t.Errorf("want the pending activation dropped with the passive phase, got %s", reason)
+	default:
+	}
+}
+
+func TestTokenRefresher_State(t *testing.T) {
+	r, cleanup := setup()
+	defer cleanup()
+	safeWrite(r.TokenFile, "")
+	c := getFakeClient(r, false)
+
+	if s := r.State(); s.Phase != PhaseInitializing || s.LastRefresh != nil {
+		t.Errorf("unexpected initial state %+v", s)
+	}
+	if err := r.refresh(c); err != nil {
+		t.Fatalf("refresh() failed: %s", err.Error())
+	}
+	s := r.State()
+	if s.LastRefresh == nil || s.LastRefresh.Error != "" {
+		t.Fatalf("want a successful last refresh, got %+v", s.LastRefresh)
+	}
+	if left := time.Until(s.LastRefresh.ExpiresAt); left <= time.Hour || left > 2*time.Hour {
+		t.Errorf("want the refreshed token to expire in 2h, got %v", left)
+	}
+	if s.Claims == nil || s.ClaimsError != "" {
+		t.Errorf("want the claims of the token file, got error %q", s.ClaimsError)
+	}
+}
@@ -0,0 +1,197 @@
+package tokenrefresher
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/process"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// watchStop merges the enabled stop conditions of the refresh loop into one channel of exit reasons.
+// The channel is nil, and never receives, if no stop condition is enabled.
+func (r *TokenRefresher) watchStop(client kubernetes.Interface, stopCh <-chan struct{}) <-chan ExitReason {
+	kinds := map[<-chan string]func(msg string) ExitKind{}
+	if len(r.PrimaryContainers) > 0 {
+		kinds[r.watchPod(client, stopCh, r.primaryContainersTerminated)] = func(msg string) ExitKind {
+			if msg == podDeleted {
+				return ExitPodDeleted
+			}
+			return ExitPrimaryContainers
+		}
+	}
+	if r.App.enabled() {
+		kinds[r.superviseApp(stopCh)] = func(string) ExitKind { return ExitAppProcess }
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+	merged := make(chan ExitReason, len(kinds))
+	for ch, kind := range kinds {
+		go func(ch <-chan string, kind func(string) ExitKind) {
+			select {
+			case msg := <-ch:
+				merged <- ExitReason{Kind: kind(msg), Message: msg}
+			case <-stopCh:
+			}
+		}(ch, kind)
+	}
+	return merged
+}
+
+// primaryContainersTerminated reports once all primary containers have terminated, along with their exit codes.
+// Containers without a status yet are considered running.
+func (r *TokenRefresher) primaryContainersTerminated(pod *corev1.Pod) (string, bool) {
+	statuses := make(map[string]corev1.ContainerStatus, len(pod.Status.ContainerStatuses))
+	for _, s := range pod.Status.ContainerStatuses {
+		statuses[s.Name] = s
+	}
+	exits := make([]string, 0, len(r.PrimaryContainers))
+	for _, name := range r.PrimaryContainers {
+		s, ok := statuses[name]
+		if !ok || s.State.Terminated == nil {
+			return "", false
+		}
+		exits = append(exits, fmt.Sprintf("%s (exit code %d, %s)", name, s.State.Terminated.ExitCode, s.State.Terminated.Reason))
+	}
+	return "Primary containers terminated: " + strings.Join(exits, ", "), true
+}
+
+// AppProcess identifies the application's process in a shared process namespace, by command line pattern or pid file
+type AppProcess struct {
+	Pattern string `mapstructure:"app_pattern"`
+	PidFile string `mapstructure:"app_pid_file"`
+}
+
+func (a AppProcess) enabled() bool {
+	return a.Pattern != "" || a.PidFile != ""
+}
+
+func (a AppProcess) validate() error {
+	if a.Pattern != "" && a.PidFile != "" {
+		return fmt.Errorf("app pattern and app pid file are mutually exclusive")
+	}
+	if _, err := regexp.Compile(a.Pattern); err != nil {
+		return fmt.Errorf("invalid app pattern: %w", err)
+	}
+	return nil
+}
+
+// find returns the processes of the app.
+// The error wraps process.ErrExited if the process of the pid file is gone.
+func (a AppProcess) find() ([]process.Process, error) {
+	if a.PidFile != "" {
+		p, err := process.FromPidFile(a.PidFile)
+		if err != nil {
+			return nil, err
+		}
+		return []process.Process{p}, nil
+	}
+	return process.Find(regexp.MustCompile(a.Pattern))
+}
+
+// appHandle keeps the processes of the app once located
+type appHandle struct {
+	mu sync.Mutex
+	ps []process.Process
+	// exited is why the app is known to have exited before being located, empty if it is not known
+	exited string
+}
+
+func (h *appHandle) get() ([]process.Process, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ps, h.exited
+}
+
+func (h *appHandle) set(ps []process.Process, exited string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ps, h.exited = ps, exited
+}
+
+// processPollInterval is how often the application's process is looked for and checked
+var processPollInterval = time.Second
+
+// locate looks for the app once, keeping the handle if found.
+// It returns true once the app is located, or known to have exited.
+func (r *TokenRefresher) locate() bool {
+	if ps, exited := r.app.get(); ps != nil || exited != "" {
+		return true
+	}
+	found, err := r.App.find()
+	switch {
+	case errors.Is(err, process.ErrExited):
+		r.app.set(nil, err.Error())
+		return true
+	case err != nil:
+		r.log().Debugf("unable to find app process: %s", err.Error())
+	case len(found) > 0:
+		for _, p := range found {
+			r.log().Infof("Supervising app process %d: %s", p.Pid, p.Cmdline)
+		}
+		r.app.set(found, "")
+		return true
+	}
+	return false
+}
+
+// locateApp looks for the app during the passive phase until it is located or stopCh is closed
+func (r *TokenRefresher) locateApp(stopCh <-chan struct{}) {
+	t := time.NewTicker(processPollInterval)
+	defer t.Stop()
+	for !r.locate() {
+		select {
+		case <-t.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// superviseApp reports once all processes of the application have exited, along with their exit status.
+// Until the application is found, the refresh loop keeps going, so that a mismatching pattern does not stop refreshing.
+// A process of the pid file which is gone, or whose pid was reused, counts as exited.
+func (r *TokenRefresher) superviseApp(stopCh <-chan struct{}) <-chan string {
+	ch := make(chan string, 1)
+	go func() {
+		t := time.NewTicker(processPollInterval)
+		defer t.Stop()
+		var exits []string
+		for {
+			if r.locate() {
+				ps, exited := r.app.get()
+				if exited != "" {
+					ch <- "App process exited: " + exited
+					return
+				}
+				running := ps[:0:0]
+				for _, p := range ps {
+					if exited, status := p.Exited(); exited {
+						r.log().Infof("App process %d exited: %s", p.Pid, status)
+						exits = append(exits, fmt.Sprintf("%d (%s)", p.Pid, status))
+					} else {
+						running = append(running, p)
+					}
+				}
+				if len(running) == 0 {
+					ch <- "App process exited: " + strings.Join(exits, ", ")
+					return
+				}
+				r.app.set(running, "")
+			}
+			select {
+			case <-t.C:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return ch
+}
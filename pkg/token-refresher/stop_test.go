@@ -0,0 +1,260 @@
+package tokenrefresher
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTokenRefresher_primaryContainers(t *testing.T) {
+	terminated := func(name string) corev1.ContainerStatus {
+		return corev1.ContainerStatus{Name: name, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}}}
+	}
+	running := func(name string) corev1.ContainerStatus {
+		return corev1.ContainerStatus{Name: name, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}
+	}
+
+	t.Run("refreshLoop() should exit when all primary containers have terminated", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		r.PodName = "test-pod"
+		r.PrimaryContainers = []string{"app", "worker"}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: r.PodName, Namespace: r.Namespace},
+			Status:     corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{running("app"), running("worker"), running("token-refresher")}},
+		}
+		c := getFakeClient(r, false)
+		if _, err := c.CoreV1().Pods(r.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unable to create pod: %s", err.Error())
+		}
+		retCh := make(chan struct{})
+
+		go func() {
+			r.refreshLoop(c, nil)
+			close(retCh)
+		}()
+
+		pod.Status.ContainerStatuses[0] = terminated("app")
+		if _, err := c.CoreV1().Pods(r.Namespace).UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("unable to update pod: %s", err.Error())
+		}
+		select {
+		case <-retCh:
+			t.Fatalf("refreshLoop() returned while a primary container is running")
+		case <-time.After(r.RefreshInterval * 2):
+		}
+		pod.Status.ContainerStatuses[1] = terminated("worker")
+		if _, err := c.CoreV1().Pods(r.Namespace).UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("unable to update pod: %s", err.Error())
+		}
+		select {
+		case <-retCh:
+		case <-time.After(r.RefreshInterval * 2):
+			t.Errorf("refreshLoop() did not return after all primary containers terminated")
+		}
+	})
+
+	t.Run("primaryContainersTerminated() should treat containers without status as running", func(t *testing.T) {
+		r := &TokenRefresher{PrimaryContainers: []string{"app"}}
+		pod := &corev1.Pod{Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{terminated("other")}}}
+		if _, ok := r.primaryContainersTerminated(pod); ok {
+			t.Errorf("primaryContainersTerminated() reported a container without status as terminated")
+		}
+	})
+}
+
+func TestTokenRefresher_superviseApp(t *testing.T) {
+	interval := processPollInterval
+	t.Cleanup(func() { processPollInterval = interval })
+	processPollInterval = 10 * time.Millisecond
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unable to start process: %s", err.Error())
+	}
+	defer cmd.Process.Kill()
+	pidFile := path.Join(t.TempDir(), "app.pid")
+	os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	r := &TokenRefresher{App: AppProcess{PidFile: pidFile}}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	ch := r.superviseApp(stopCh)
+	select {
+	case <-ch:
+		t.Fatalf("superviseApp() reported a running app as exited")
+	case <-time.After(100 * time.Millisecond):
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Errorf("superviseApp() did not report the exited app")
+	}
+}
+
+func TestTokenRefresher_appExitedBeforeRefreshLoop(t *testing.T) {
+	interval := processPollInterval
+	t.Cleanup(func() { processPollInterval = interval })
+	processPollInterval = 10 * time.Millisecond
+	// the argument makes the command line unique among concurrently running tests
+	arg := "30." + strconv.Itoa(os.Getpid())
+	start := func(t *testing.T) *exec.Cmd {
+		cmd := exec.Command("sleep", arg)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("unable to start process: %s", err.Error())
+		}
+		t.Cleanup(func() { cmd.Process.Kill() })
+		return cmd
+	}
+	refreshLoop := func(t *testing.T, r *TokenRefresher) {
+		retCh := make(chan ExitReason, 1)
+		go func() {
+			retCh <- r.refreshLoop(getFakeClient(r, false), nil)
+		}()
+		select {
+		case reason := <-retCh:
+			if reason.Kind != ExitAppProcess {
+				t.Errorf("want exit reason %s, got %s", ExitAppProcess, reason)
+			}
+		case <-time.After(r.ShutdownInterval * 5):
+			t.Errorf("refreshLoop() did not return")
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		app  func(t *testing.T, cmd *exec.Cmd) AppProcess
+	}{
+		{name: "pid file", app: func(t *testing.T, cmd *exec.Cmd) AppProcess {
+			pidFile := path.Join(t.TempDir(), "app.pid")
+			os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+			return AppProcess{PidFile: pidFile}
+		}},
+		{name: "pattern", app: func(t *testing.T, cmd *exec.Cmd) AppProcess {
+			return AppProcess{Pattern: `^sleep ` + regexp.QuoteMeta(arg) + `$`}
+		}},
+	} {
+		t.Run("refreshLoop() should stop for an app located during the passive phase which exited since, by "+tt.name, func(t *testing.T) {
+			r, cleanup := setup()
+			defer cleanup()
+			safeWrite(r.TokenFile, "")
+			cmd := start(t)
+			r.App = tt.app(t, cmd)
+			stopCh := make(chan struct{})
+			r.locateApp(stopCh)
+			close(stopCh)
+			cmd.Process.Kill()
+			cmd.Wait()
+			refreshLoop(t, r)
+		})
+	}
+
+	t.Run("refreshLoop() should stop for a pid file whose process is gone", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		cmd := start(t)
+		cmd.Process.Kill()
+		cmd.Wait()
+		pidFile := path.Join(t.TempDir(), "app.pid")
+		os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+		r.App = AppProcess{PidFile: pidFile}
+		refreshLoop(t, r)
+	})
+}
+
+func TestTokenRefresher_refreshLoopExitReason(t *testing.T) {
+	interval := processPollInterval
+	t.Cleanup(func() { processPollInterval = interval })
+	processPollInterval = 10 * time.Millisecond
+	running := corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}
+	terminated := corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}}
+	withPod := func(r *TokenRefresher, status corev1.ContainerStatus) *testclient.Clientset {
+		r.PodName = "test-pod"
+		r.PrimaryContainers = []string{"app"}
+		c := getFakeClient(r, false)
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: r.PodName, Namespace: r.Namespace},
+			Status:     corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{status}},
+		}
+		c.CoreV1().Pods(r.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+		return c
+	}
+
+	tests := []struct {
+		name string
+		want ExitKind
+		// prepare returns the client and a function which fires the stop source once the loop is running
+		prepare func(t *testing.T, r *TokenRefresher) (*testclient.Clientset, func())
+	}{
+		{name: "termination deadline", want: ExitDeadline, prepare: func(t *testing.T, r *TokenRefresher) (*testclient.Clientset, func()) {
+			r.deadline = time.Now().Add(-time.Second)
+			return getFakeClient(r, false), func() {}
+		}},
+		{name: "primary containers", want: ExitPrimaryContainers, prepare: func(t *testing.T, r *TokenRefresher) (*testclient.Clientset, func()) {
+			return withPod(r, terminated), func() {}
+		}},
+		{name: "pod deletion", want: ExitPodDeleted, prepare: func(t *testing.T, r *TokenRefresher) (*testclient.Clientset, func()) {
+			c := withPod(r, running)
+			return c, func() {
+				c.CoreV1().Pods(r.Namespace).Delete(context.TODO(), r.PodName, metav1.DeleteOptions{})
+			}
+		}},
+		{name: "app process", want: ExitAppProcess, prepare: func(t *testing.T, r *TokenRefresher) (*testclient.Clientset, func()) {
+			cmd := exec.Command("sleep", "30")
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("unable to start process: %s", err.Error())
+			}
+			t.Cleanup(func() { cmd.Process.Kill() })
+			pidFile := path.Join(t.TempDir(), "app.pid")
+			os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+			r.App = AppProcess{PidFile: pidFile}
+			return getFakeClient(r, false), func() {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}
+		}},
+		{name: "heartbeat", want: ExitHeartbeat, prepare: func(t *testing.T, r *TokenRefresher) (*testclient.Clientset, func()) {
+			safeWrite(r.TokenFile, getTokenWithExpiry(-time.Minute))
+			r.Heartbeat = Heartbeat{File: r.TokenFile + ".heartbeat", Window: time.Minute, last: time.Now().Add(-2 * time.Minute)}
+			return getFakeClient(r, false), func() {}
+		}},
+		{name: "shutdown file", want: ExitShutdownFile, prepare: func(t *testing.T, r *TokenRefresher) (*testclient.Clientset, func()) {
+			return getFakeClient(r, false), func() { safeWrite(r.shutdownFile, "") }
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, cleanup := setup()
+			defer cleanup()
+			safeWrite(r.TokenFile, "")
+			c, fire := tt.prepare(t, r)
+			retCh := make(chan ExitReason, 1)
+
+			go func() {
+				retCh <- r.refreshLoop(c, nil)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			fire()
+			select {
+			case reason := <-retCh:
+				if reason.Kind != tt.want {
+					t.Errorf("want exit reason %s, got %s", tt.want, reason)
+				}
+			case <-time.After(r.ShutdownInterval * 5):
+				t.Errorf("refreshLoop() did not return")
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package tokenrefresher
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SinkSTS exchanges refreshed tokens for temporary AWS credentials
+const SinkSTS = "sts"
+
+// Defaults of the sts sink
+const (
+	DefaultSTSProfile       = "default"
+	DefaultSTSSessionName   = "token-refresher"
+	DefaultSTSRefreshBefore = 5 * time.Minute
+	// MinSTSDuration is the shortest session STS accepts
+	MinSTSDuration = 15 * time.Minute
+
+	stsCredentialsFile = "credentials"
+	stsVersion         = "2011-06-15"
+
+	// failed renewals are retried with a backoff from stsMinRetry up to stsMaxRetry,
+	// independently of the retries of token refreshes
+	stsMinRetry = 5 * time.Second
+	stsMaxRetry = 5 * time.Minute
+)
+
+// STSSettings configure the sts sink, which exchanges refreshed tokens for temporary AWS credentials.
+// Unset settings fall back to the environment variables the AWS SDKs read.
+type STSSettings struct {
+	// RoleARN is the role to assume, AWS_ROLE_ARN by default
+	RoleARN string `mapstructure:"sts_role_arn"`
+	// SessionName is AWS_ROLE_SESSION_NAME by default, else DefaultSTSSessionName
+	SessionName string `mapstructure:"sts_session_name"`
+	// Endpoint is AWS_ENDPOINT_URL_STS by default, else the regional endpoint of AWS_REGION, else the global one
+	Endpoint string `mapstructure:"sts_endpoint"`
+	// Duration of the session, the default of the role if unset
+	Duration time.Duration `mapstructure:"sts_duration"`
+	// CredentialsFile defaults to credentials in the directory of the token file
+	CredentialsFile string `mapstructure:"sts_credentials_file"`
+	Profile         string `mapstructure:"sts_profile"`
+	// RefreshBefore is how long before their expiry the credentials are renewed
+	RefreshBefore time.Duration `mapstructure:"sts_refresh_before"`
+}
+
+func (s STSSettings) roleARN() string {
+	if s.RoleARN != "" {
+		return s.RoleARN
+	}
+	return os.Getenv("AWS_ROLE_ARN")
+}
+
+func (s STSSettings) sessionName() string {
+	if s.SessionName != "" {
+		return s.SessionName
+	}
+	if name := os.Getenv("AWS_ROLE_SESSION_NAME"); name != "" {
+		return name
+	}
+	return DefaultSTSSessionName
+}
+
+func (s STSSettings) endpoint() string {
+	if s.Endpoint != "" {
+		return s.Endpoint
+	}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_STS"); endpoint != "" {
+		return endpoint
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return "https://sts." + region + ".amazonaws.com"
+	}
+	return "https://sts.amazonaws.com"
+}
+
+func (s STSSettings) profile() string {
+	if s.Profile == "" {
+		return DefaultSTSProfile
+	}
+	return s.Profile
+}
+
+func (s STSSettings) refreshBefore() time.Duration {
+	if s.RefreshBefore <= 0 {
+		return DefaultSTSRefreshBefore
+	}
+	return s.RefreshBefore
+}
+
+func (s STSSettings) validate() error {
+	if arn := s.roleARN(); !strings.HasPrefix(arn, "arn:") {
+		return fmt.Errorf("role arn %q of the %s sink must be an arn, set sts_role_arn or AWS_ROLE_ARN", arn, SinkSTS)
+	}
+	if u, err := url.Parse(s.endpoint()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("sts endpoint %q must be an absolute http or https url", s.endpoint())
+	}
+	if s.Duration != 0 && s.Duration < MinSTSDuration {
+		return fmt.Errorf("sts duration %v must be at least %v", s.Duration, MinSTSDuration)
+	}
+	if s.Duration != 0 && s.refreshBefore() >= s.Duration {
+		return fmt.Errorf("sts refresh before %v must be shorter than the sts duration %v", s.refreshBefore(), s.Duration)
+	}
+	return nil
+}
+
+// credentialsFile returns where the credentials are written
+func (r *TokenRefresher) credentialsFile() string {
+	if r.STS.CredentialsFile != "" {
+		return r.STS.CredentialsFile
+	}
+	return path.Join(path.Dir(r.TokenFile), stsCredentialsFile)
+}
+
+// AWSCredentials are temporary credentials returned by STS
+type AWSCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+type assumeRoleResponse struct {
+	Credentials AWSCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+type stsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// assumeRole calls AssumeRoleWithWebIdentity, which is not signed as the token is the credential
+func (s STSSettings) assumeRole(ctx context.Context, token string) (AWSCredentials, error) {
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {stsVersion},
+		"RoleArn":          {s.roleARN()},
+		"RoleSessionName":  {s.sessionName()},
+		"WebIdentityToken": {token},
+	}
+	if s.Duration != 0 {
+		form.Set("DurationSeconds", strconv.FormatInt(int64(s.Duration.Seconds()), 10))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("unable to call %s: %w", s.endpoint(), err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenSize))
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("unable to read response of %s: %w", s.endpoint(), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e stsErrorResponse
+		if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+			return AWSCredentials{}, fmt.Errorf("unable to assume role %s: %s: %s", s.roleARN(), e.Code, e.Message)
+		}
+		return AWSCredentials{}, fmt.Errorf("unexpected status from %s: %s", s.endpoint(), resp.Status)
+	}
+	var ar assumeRoleResponse
+	if err := xml.Unmarshal(body, &ar); err != nil {
+		return AWSCredentials{}, fmt.Errorf("unable to decode response of %s: %w", s.endpoint(), err)
+	}
+	if ar.Credentials.AccessKeyID == "" {
+		return AWSCredentials{}, fmt.Errorf("no credentials in the response of %s", s.endpoint())
+	}
+	return ar.Credentials, nil
+}
+
+// stsState is shared between the sink and the loop renewing the credentials before they expire
+type stsState struct {
+	mu sync.Mutex
+	// token is the latest token delivered to the sink
+	token string
+	// expiresAt is when the written credentials expire
+	expiresAt time.Time
+	// renewAt is when the credentials have to be renewed, zero if there is nothing to renew
+	renewAt time.Time
+	// failures counts the renewals which failed in a row
+	failures int
+	changed  chan struct{}
+	// writing serializes exchanging tokens, so that credentials of an older token never replace newer ones
+	writing sync.Mutex
+}
+
+func (r *TokenRefresher) stsState() *stsState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sts == nil {
+		r.sts = &stsState{changed: make(chan struct{}, 1)}
+	}
+	return r.sts
+}
+
+// set records the credentials written for a newly refreshed token and wakes up the renewal loop
+func (s *stsState) set(token string, expiresAt, renewAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+	s.expiresAt = expiresAt
+	s.renewAt = renewAt
+	s.failures = 0
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// renewed records when to renew next, unless a newer token has been written meanwhile
+func (s *stsState) renewed(token string, expiresAt, renewAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.expiresAt = expiresAt
+		s.renewAt = renewAt
+		s.failures = 0
+	}
+}
+
+// failed schedules the retry of a failed renewal with a backoff, but not past the expiry of the credentials
+func (s *stsState) failed(token string, now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != token {
+		return s.renewAt
+	}
+	s.failures++
+	retry := min(stsMinRetry<<min(s.failures-1, 16), stsMaxRetry)
+	s.renewAt = now.Add(retry)
+	if s.expiresAt.After(now) && s.renewAt.After(s.expiresAt) {
+		s.renewAt = s.expiresAt
+	}
+	return s.renewAt
+}
+
+func (s *stsState) get() (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token, s.renewAt
+}
+
+// exchange assumes the role with the token and writes the credentials, returning when they expire
+func (r *TokenRefresher) exchange(ctx context.Context, token string) (time.Time, error) {
+	creds, err := r.STS.assumeRole(ctx, token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := r.writeCredentials(creds); err != nil {
+		return time.Time{}, err
+	}
+	r.log().Infof("Wrote credentials of %s to profile %s of %s, expiring at %s",
+		r.STS.roleARN(), r.STS.profile(), r.credentialsFile(), creds.Expiration.Format(time.RFC3339))
+	return creds.Expiration, nil
+}
+
+// writeCredentials replaces the profile in the shared credentials file, keeping the other profiles
+func (r *TokenRefresher) writeCredentials(creds AWSCredentials) error {
+	b, err := os.ReadFile(r.credentialsFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read credentials file: %w", err)
+	}
+	return safeWrite(r.credentialsFile(), replaceProfile(string(b), r.STS.profile(), formatCredentials(r.STS.profile(), creds)))
+}
+
+// formatCredentials returns the section of a profile in a shared credentials file
+func formatCredentials(profile string, creds AWSCredentials) string {
+	return fmt.Sprintf("[%s]\naws_access_key_id = %s\naws_secret_access_key = %s\naws_session_token = %s\nx_security_token_expires = %s\n",
+		profile, creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken, creds.Expiration.Format(time.RFC3339))
+}
+
+// replaceProfile replaces the section of the profile in a shared credentials file, or appends it
+func replaceProfile(file, profile, section string) string {
+	var out []string
+	inProfile, replaced := false, false
+	for _, line := range strings.SplitAfter(file, "\n") {
+		if line == "" {
+			continue
+		}
+		if name, ok := sectionName(line); ok {
+			inProfile = name == profile
+			if inProfile && !replaced {
+				out = append(out, section)
+				replaced = true
+			}
+		}
+		if !inProfile {
+			out = append(out, line)
+		}
+	}
+	if len(out) > 0 && !strings.HasSuffix(out[len(out)-1], "\n") {
+		out = append(out, "\n")
+	}
+	if !replaced {
+		out = append(out, section)
+	}
+	return strings.Join(out, "")
+}
+
+// sectionName returns the name of the section the line starts, if it does
+func sectionName(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return "", false
+	}
+	return strings.TrimSpace(line[1 : len(line)-1]), true
+}
+
+func newSTSSink(env sinkEnv) (Sink, error) {
+	r := env.Refresher
+	return SinkFunc(func(ctx context.Context, token string) error {
+		s := r.stsState()
+		s.writing.Lock()
+		defer s.writing.Unlock()
+		expiresAt, err := r.exchange(ctx, token)
+		if err != nil {
+			return err
+		}
+		s.set(token, expiresAt, expiresAt.Add(-r.STS.refreshBefore()))
+		return nil
+	}), nil
+}
+
+// renewCredentials renews the credentials with the latest token before they expire until stop is closed
+func (r *TokenRefresher) renewCredentials(stop <-chan struct{}) {
+	s := r.stsState()
+	for {
+		token, renewAt := s.get()
+		var timer *time.Timer
+		var renew <-chan time.Time
+		if !renewAt.IsZero() {
+			timer = time.NewTimer(renewAt.Sub(r.now()))
+			renew = timer.C
+		}
+		due := false
+		select {
+		case <-stop:
+		case <-s.changed:
+		case <-renew:
+			due = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if due {
+			r.renew(s, token)
+		}
+	}
+}
+
+// renew exchanges the token for new credentials, unless it has expired or the sink has written a newer one
+func (r *TokenRefresher) renew(s *stsState, token string) {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	if latest, _ := s.get(); latest != token {
+		return
+	}
+	if expiresAt, err := tokenExpiry(token); err != nil || !expiresAt.After(r.now()) {
+		r.log().Warnf("Not renewing credentials as the latest token has expired, waiting for a refresh")
+		s.renewed(token, time.Time{}, time.Time{})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.Sink.timeout())
+	defer cancel()
+	expiresAt, err := r.exchange(ctx, token)
+	if err != nil {
+		now := r.now()
+		retryAt := s.failed(token, now)
+		r.log().Errorf("unable to renew credentials, retrying in %v: %s", retryAt.Sub(now), err.Error())
+		return
+	}
+	s.renewed(token, expiresAt, expiresAt.Add(-r.STS.refreshBefore()))
+}
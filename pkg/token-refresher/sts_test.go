@@ -0,0 +1,311 @@
+package tokenrefresher
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSTS answers AssumeRoleWithWebIdentity with credentials expiring at expiresAt of the number of the call, starting at 1
+type fakeSTS struct {
+	*httptest.Server
+	mu     sync.Mutex
+	forms  []map[string]string
+	called chan struct{}
+	// first, if set, holds up the answer to the first call until it is closed
+	first chan struct{}
+}
+
+func newFakeSTS(t *testing.T, expiresAt func(n int) time.Time) *fakeSTS {
+	s := &fakeSTS{called: make(chan struct{}, 16)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		s.mu.Lock()
+		n := len(s.forms) + 1
+		form := map[string]string{}
+		for k := range req.PostForm {
+			form[k] = req.PostForm.Get(k)
+		}
+		s.forms = append(s.forms, form)
+		s.mu.Unlock()
+		defer func() { s.called <- struct{}{} }()
+		if n == 1 && s.first != nil {
+			<-s.first
+		}
+		if strings.Count(form["WebIdentityToken"], ".") != 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>InvalidIdentityToken</Code><Message>Token is not a JWT</Message></Error></ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>AKID%d</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, n, expiresAt(n).UTC().Format(time.RFC3339Nano))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// expiringAfter returns credentials expiring n times d after start on the nth call
+func expiringAfter(start time.Time, d time.Duration) func(n int) time.Time {
+	return func(n int) time.Time { return start.Add(time.Duration(n) * d) }
+}
+
+func (s *fakeSTS) calls() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]string(nil), s.forms...)
+}
+
+func TestSTSSettings_validate(t *testing.T) {
+	t.Setenv("AWS_ROLE_ARN", "")
+	tests := []struct {
+		name    string
+		sts     STSSettings
+		env     string
+		wantErr bool
+	}{
+		{name: "role arn", sts: STSSettings{RoleARN: "arn:aws:iam::123456789012:role/app"}},
+		{name: "role arn from env", env: "arn:aws:iam::123456789012:role/app"},
+		{name: "missing role arn", wantErr: true},
+		{name: "relative endpoint", sts: STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: "sts"}, wantErr: true},
+		{name: "short duration", sts: STSSettings{RoleARN: "arn:aws:iam::1:role/app", Duration: time.Minute}, wantErr: true},
+		{name: "renewal after expiry", sts: STSSettings{RoleARN: "arn:aws:iam::1:role/app", Duration: time.Hour, RefreshBefore: time.Hour}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_ROLE_ARN", tt.env)
+			if err := tt.sts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenRefresher_stsSink(t *testing.T) {
+	t.Run("sts sink should write the credentials of the assumed role", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		sts := newFakeSTS(t, expiringAfter(time.Now(), time.Hour))
+		r.Sinks = []string{SinkSTS}
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: sts.URL, Profile: "app", Duration: time.Hour}
+		token := getTokenWithExpiry(time.Hour)
+
+		if _, err := r.deliver(nil, token); err != nil {
+			t.Fatalf("deliver() failed: %s", err.Error())
+		}
+		calls := sts.calls()
+		if len(calls) != 1 || calls[0]["WebIdentityToken"] != token || calls[0]["RoleArn"] != r.STS.RoleARN ||
+			calls[0]["RoleSessionName"] != DefaultSTSSessionName || calls[0]["DurationSeconds"] != "3600" {
+			t.Errorf("unexpected calls %v", calls)
+		}
+		b, err := os.ReadFile(r.credentialsFile())
+		if err != nil {
+			t.Fatalf("unable to read credentials: %s", err.Error())
+		}
+		if got := string(b); !strings.HasPrefix(got, "[app]\n") || !strings.Contains(got, "aws_access_key_id = AKID1\n") ||
+			!strings.Contains(got, "aws_session_token = session\n") {
+			t.Errorf("unexpected credentials file %q", got)
+		}
+	})
+
+	t.Run("sts sink should keep the other profiles of the credentials file", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		sts := newFakeSTS(t, expiringAfter(time.Now(), time.Hour))
+		r.Sinks = []string{SinkSTS}
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: sts.URL, Profile: "app"}
+		safeWrite(r.credentialsFile(), "[default]\naws_access_key_id = OTHER\n\n[app]\naws_access_key_id = OLD\n[dev]\nregion = us-east-1")
+
+		if _, err := r.deliver(nil, getTokenWithExpiry(time.Hour)); err != nil {
+			t.Fatalf("deliver() failed: %s", err.Error())
+		}
+		b, _ := os.ReadFile(r.credentialsFile())
+		got := string(b)
+		if !strings.HasPrefix(got, "[default]\naws_access_key_id = OTHER\n\n[app]\naws_access_key_id = AKID1\n") ||
+			!strings.HasSuffix(got, "[dev]\nregion = us-east-1\n") || strings.Contains(got, "OLD") {
+			t.Errorf("want only the app profile replaced, got %q", got)
+		}
+	})
+
+	t.Run("sts sink should fail with the error of STS", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.Sinks = []string{SinkSTS}
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: newFakeSTS(t, expiringAfter(time.Now(), time.Hour)).URL}
+
+		if _, err := r.deliver(nil, "not-a-jwt"); err == nil || !strings.Contains(err.Error(), "InvalidIdentityToken") {
+			t.Errorf("want the error code of STS, got %v", err)
+		}
+	})
+
+	t.Run("renew() should renew the credentials and schedule the next renewal", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		start := time.Now()
+		sts := newFakeSTS(t, expiringAfter(start, time.Hour))
+		r.Sinks = []string{SinkSTS}
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: sts.URL}
+		r.Apply(WithClock(fixedClock{start}))
+		token := getTokenWithExpiry(time.Hour * 2)
+
+		if _, err := r.deliver(nil, token); err != nil {
+			t.Fatalf("deliver() failed: %s", err.Error())
+		}
+		s := r.stsState()
+		if _, renewAt := s.get(); !renewAt.Equal(start.Add(time.Hour - DefaultSTSRefreshBefore)) {
+			t.Errorf("want the renewal %v before the expiry, got %v", DefaultSTSRefreshBefore, renewAt)
+		}
+		r.Apply(WithClock(fixedClock{start.Add(time.Hour - time.Minute)}))
+		r.renew(s, token)
+		if _, renewAt := s.get(); !renewAt.Equal(start.Add(2*time.Hour - DefaultSTSRefreshBefore)) {
+			t.Errorf("want the next renewal before the expiry of the renewed credentials, got %v", renewAt)
+		}
+		if b, _ := os.ReadFile(r.credentialsFile()); !strings.Contains(string(b), "aws_access_key_id = AKID2\n") {
+			t.Errorf("want the renewed credentials written, got %q", b)
+		}
+	})
+
+	t.Run("renew() should not overwrite the credentials of a newer token", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		sts := newFakeSTS(t, expiringAfter(time.Now(), time.Hour))
+		sts.first = make(chan struct{})
+		r.Sinks = []string{SinkSTS}
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: sts.URL}
+		old, latest := getTokenWithExpiry(time.Hour), getTokenWithExpiry(time.Hour*2)
+		s := r.stsState()
+		s.set(old, time.Now().Add(time.Hour), time.Now())
+
+		renewed := make(chan struct{})
+		go func() {
+			r.renew(s, old)
+			close(renewed)
+		}()
+		// wait for the renewal to call STS before the sink writes the latest token
+		for len(sts.calls()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		delivered := make(chan error)
+		go func() {
+			_, err := r.deliver(nil, latest)
+			delivered <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		close(sts.first)
+		<-renewed
+		if err := <-delivered; err != nil {
+			t.Fatalf("deliver() failed: %s", err.Error())
+		}
+		if b, _ := os.ReadFile(r.credentialsFile()); !strings.Contains(string(b), "aws_access_key_id = AKID2\n") {
+			t.Errorf("want the credentials of the latest token, got %q", b)
+		}
+
+		r.renew(s, old)
+		if n := len(sts.calls()); n != 2 {
+			t.Errorf("want no renewal with a token older than the latest one, got %d calls", n)
+		}
+		if token, _ := s.get(); token != latest {
+			t.Errorf("want the latest token kept")
+		}
+	})
+
+	t.Run("renew() should back off if STS fails, regardless of the retry sleep", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		sts := newFakeSTS(t, expiringAfter(time.Now(), time.Hour))
+		sts.Close()
+		now := time.Now()
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: sts.URL}
+		r.Retryer.Sleep = 0
+		r.Apply(WithClock(fixedClock{now}))
+		token := getTokenWithExpiry(time.Hour * 2)
+		s := r.stsState()
+		s.set(token, now.Add(time.Hour), now)
+
+		for _, want := range []time.Duration{stsMinRetry, 2 * stsMinRetry, 4 * stsMinRetry} {
+			r.renew(s, token)
+			if _, renewAt := s.get(); !renewAt.Equal(now.Add(want)) {
+				t.Errorf("want a retry after %v, got %v", want, renewAt.Sub(now))
+			}
+		}
+		for i := 0; i < 20; i++ {
+			r.renew(s, token)
+		}
+		if _, renewAt := s.get(); !renewAt.Equal(now.Add(stsMaxRetry)) {
+			t.Errorf("want the retry capped at %v, got %v", stsMaxRetry, renewAt.Sub(now))
+		}
+	})
+
+	t.Run("renew() should not back off past the expiry of the credentials", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		sts := newFakeSTS(t, expiringAfter(time.Now(), time.Hour))
+		sts.Close()
+		now := time.Now()
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: sts.URL}
+		r.Apply(WithClock(fixedClock{now}))
+		token := getTokenWithExpiry(time.Hour * 2)
+		s := r.stsState()
+		s.set(token, now.Add(time.Second), now)
+
+		r.renew(s, token)
+		if _, renewAt := s.get(); !renewAt.Equal(now.Add(time.Second)) {
+			t.Errorf("want a retry at the expiry of the credentials, got %v", renewAt.Sub(now))
+		}
+	})
+
+	t.Run("renew() should not renew with an expired token", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		sts := newFakeSTS(t, expiringAfter(time.Now(), time.Hour))
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: sts.URL}
+		token := getTokenWithExpiry(-time.Minute)
+		s := r.stsState()
+		s.set(token, time.Now().Add(time.Hour), time.Now())
+
+		r.renew(s, token)
+		if n := len(sts.calls()); n != 0 {
+			t.Errorf("want no renewal with an expired token, got %d calls", n)
+		}
+		if _, renewAt := s.get(); !renewAt.IsZero() {
+			t.Errorf("want no renewal scheduled until the next refresh, got %v", renewAt)
+		}
+	})
+
+	t.Run("renewCredentials() should renew once the clock reaches the renewal", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		start := time.Now()
+		sts := newFakeSTS(t, expiringAfter(start, time.Hour))
+		r.Sinks = []string{SinkSTS}
+		r.STS = STSSettings{RoleARN: "arn:aws:iam::1:role/app", Endpoint: sts.URL}
+		// past the renewal of the first credentials, but not of the renewed ones
+		r.Apply(WithClock(fixedClock{start.Add(time.Hour - time.Minute)}))
+		stop := make(chan struct{})
+		defer close(stop)
+		go r.renewCredentials(stop)
+
+		if _, err := r.deliver(nil, getTokenWithExpiry(time.Hour*2)); err != nil {
+			t.Fatalf("deliver() failed: %s", err.Error())
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case <-sts.called:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("want the credentials renewed, got %d calls", len(sts.calls()))
+			}
+		}
+	})
+}
@@ -1,181 +1,412 @@
 package tokenrefresher
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"path"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/hooks"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
 	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/retry"
 	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/ticker"
 
-	v1 "k8s.io/api/authentication/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
 // ShutdownFile indicates to token refresher that it can exit gracefuly now and cleanup the file on exit.
-// Must be in the same directory as TokenFile. Content does not matter.
+// Unless configured otherwise, it is expected in the same directory as TokenFile.
 const ShutdownFile = "shutdown"
 
 type TokenRefresher struct {
-	Namespace          string        `mapstructure:"namespace"`
-	ServiceAccount     string        `mapstructure:"service_account"`
-	KubeConfig         string        `mapstructure:"kubeconfig"`
-	DefaultTokenFile   string        `mapstructure:"default_token_file"`
-	TokenFile          string        `mapstructure:"token_file"`
-	TokenAudience      []string      `mapstructure:"token_audience"`
-	ExpirationDuration time.Duration `mapstructure:"expiration_duration"`
-	RefreshInterval    time.Duration `mapstructure:"refresh_interval"`
-	ShutdownInterval   time.Duration `mapstructure:"shutdown_interval"`
-	Retryer            retry.Retryer `mapstructure:",squash"`
+	Namespace          string           `mapstructure:"namespace"`
+	ServiceAccount     string           `mapstructure:"service_account"`
+	PodName            string           `mapstructure:"pod_name"`
+	KubeConfig         string           `mapstructure:"kubeconfig"`
+	DefaultTokenFile   string           `mapstructure:"default_token_file"`
+	TokenFile          string           `mapstructure:"token_file"`
+	TokenAudience      []string         `mapstructure:"token_audience"`
+	ExpirationDuration time.Duration    `mapstructure:"expiration_duration"`
+	RefreshInterval    time.Duration    `mapstructure:"refresh_interval"`
+	ShutdownInterval   time.Duration    `mapstructure:"shutdown_interval"`
+	Shutdown           ShutdownSettings `mapstructure:",squash"`
+	Retryer            retry.Retryer    `mapstructure:",squash"`
+	Hooks              hooks.Hooks      `mapstructure:",squash"`
+	EKSAnnotations     bool             `mapstructure:"eks_annotations"`
+	Sinks              []string         `mapstructure:"sinks"`
+	Sink               SinkSettings     `mapstructure:",squash"`
+	STS                STSSettings      `mapstructure:",squash"`
+	Secret             SecretSink       `mapstructure:",squash"`
+	Trigger            TriggerSettings  `mapstructure:",squash"`
+	// WatchPod enters the active phase as soon as the pod is marked for deletion
+	WatchPod bool `mapstructure:"watch_pod"`
+	// App stops the refresh loop once the application's process has exited
+	App       AppProcess `mapstructure:",squash"`
+	Heartbeat Heartbeat  `mapstructure:",squash"`
+	// PrimaryContainers stop the refresh loop once all of them have terminated
+	PrimaryContainers []string `mapstructure:"primary_containers"`
+	// TerminationDeadline cuts refreshed tokens to the pod's termination deadline and stops refreshing once it has passed
+	TerminationDeadline bool `mapstructure:"termination_deadline"`
+	// Admin serves the local admin API
+	Admin AdminSettings `mapstructure:",squash"`
+	// TokenAPI serves the current token to applications
+	TokenAPI TokenAPISettings `mapstructure:",squash"`
+	// Source is where refreshed tokens come from
+	Source SourceSettings `mapstructure:",squash"`
+
+	client    kubernetes.Interface
+	source    TokenSource
+	clock     Clock
+	logger    logger.Logger
+	signal    <-chan struct{}
+	callbacks callbacks
 
 	minExpiryDuration time.Duration
 	shutdownFile      string
+	// scheduledShutdown is when the shutdown file says to stop. Only used by the refresh loop.
+	scheduledShutdown time.Time
+	// heartbeatStale is set while the app's heartbeat is stale. Only used by the refresh loop.
+	heartbeatStale bool
+	// tokens is served by the token API, nil if it is disabled. Set before the refresh loop starts.
+	tokens *tokenCache
+	// customSinks are added by WithSink
+	customSinks map[string]Sink
+	// customTriggers are added by WithTrigger
+	customTriggers map[string]TriggerFactory
+	// sts is shared by the sts sink and the loop renewing its credentials
+	sts *stsState
+	// app holds the app's processes once located, so that their exit is noticed even before the refresh loop starts
+	app appHandle
+
+	// mu guards the settings which can be changed by Reload while running and the state
+	mu       sync.RWMutex
+	reloaded chan struct{}
+	// triggerReason records why the active phase was entered
+	triggerReason string
+	// deadline is when the pod is going to be killed, zero if unknown. Only written by the refresh loop.
+	deadline     time.Time
+	phase        string
+	lastRefresh  *RefreshResult
+	nextRefresh  time.Time
+	retryAttempt int
+	force        chan struct{}
+	activate     chan string
 }
 
-func (r TokenRefresher) Run(stopCh <-chan struct{}) error {
-	client, err := r.Init()
+// Run initializes the refresher, waits for a trigger and refreshes tokens until the refresh loop ends
+// or ctx is done. The returned error is only set if the refresher could not be started.
+func (r *TokenRefresher) Run(ctx context.Context) (reason ExitReason, err error) {
+	defer func() {
+		r.setPhase(PhaseStopped)
+		r.log().Infof("Exiting: %s", reason)
+		for _, f := range r.callbacks.onShutdown {
+			f(reason)
+		}
+	}()
+	if err := r.Init(); err != nil {
+		return r.failed(fmt.Errorf("unable to initialize: %w", err))
+	}
+	if r.Heartbeat.enabled() {
+		closeHeartbeat, err := r.Heartbeat.start(r.log())
+		if err != nil {
+			return r.failed(err)
+		}
+		defer closeHeartbeat()
+	}
+	if r.Admin.enabled() {
+		closeAdmin, err := r.serveAdmin()
+		if err != nil {
+			return r.failed(err)
+		}
+		defer closeAdmin()
+	}
+	if r.TokenAPI.enabled() {
+		closeTokenAPI, err := r.serveTokenAPI(r.client)
+		if err != nil {
+			return r.failed(err)
+		}
+		defer closeTokenAPI()
+	}
+	if r.hasSink(SinkSTS) {
+		stopRenewal := make(chan struct{})
+		go r.renewCredentials(stopRenewal)
+		defer close(stopRenewal)
+	}
+	if r.App.enabled() {
+		stopLocating := make(chan struct{})
+		go r.locateApp(stopLocating)
+		defer close(stopLocating)
+	}
+	r.setPhase(PhasePassive)
+	fired, err := r.waitForTrigger(ctx, r.client, r.signal)
 	if err != nil {
-		return fmt.Errorf("unable to initialize: %w", err)
+		return r.failed(err)
+	}
+	if fired == nil {
+		return ExitReason{Kind: ExitStopped, Message: "Stopped before being triggered"}, nil
+	}
+	r.setPhase(PhaseActive)
+	for _, f := range r.callbacks.onTrigger {
+		f(r.TriggerReason())
+	}
+	if r.TerminationDeadline {
+		r.updateDeadline(r.client, slices.Contains(fired, TriggerSignal))
+	}
+	return r.refreshLoop(r.client, ctx.Done()), nil
+}
+
+// failed reports an error which prevents the refresher from running
+func (r *TokenRefresher) failed(err error) (ExitReason, error) {
+	for _, f := range r.callbacks.onError {
+		f(err)
+	}
+	return ExitReason{Kind: ExitError, Message: err.Error()}, err
+}
+
+// Init discovers the settings which are not configured, validates them and prepares the sinks.
+// The Kubernetes client is created if needed, unless one was given by WithClient.
+func (r *TokenRefresher) Init() error {
+	if r.client == nil && r.needsKube() {
+		client, err := createKubeClient(r.KubeConfig)
+		if err != nil {
+			return err
+		}
+		r.client = client
+	}
+	client := r.client
+	r.discoverIdentity()
+	if r.EKSAnnotations {
+		if err := r.importEKSAnnotations(client); err != nil {
+			return err
+		}
+	}
+	r.discoverToken()
+	r.minExpiryDuration = minExpiryFor(r.RefreshInterval)
+	r.shutdownFile = r.shutdownPath()
+	r.Heartbeat.clock = r.clock
+	r.log().Infof("Running TokenRefresher with config: %s", r)
+	if err := r.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if err := r.CheckShutdownDir(); err != nil {
+		return err
+	}
+	if r.hasSink(SinkFile) {
+		err := r.ensureTarget()
+		if err != nil {
+			return err
+		}
+	}
+	if r.hasSink(SinkSecret) {
+		if err := r.Secret.init(client, r.Namespace, r.PodName, r.log()); err != nil {
+			return fmt.Errorf("unable to initialize %s sink: %w", SinkSecret, err)
+		}
 	}
-	r.waitForTrigger(stopCh)
-	r.refreshLoop(client)
 	return nil
 }
 
-func (r *TokenRefresher) Init() (kubernetes.Interface, error) {
-	r.minExpiryDuration = r.RefreshInterval + r.RefreshInterval/2
-	r.shutdownFile = path.Join(path.Dir(r.TokenFile), ShutdownFile)
-	fmt.Printf("Running TokenRefresher with config: %+v\n", *r)
-	err := r.ensureTarget()
-	if err != nil {
-		return nil, err
+// needsKube tells whether the Kubernetes API is used: the file, exec and http sources run without it
+// unless a Kubernetes feature is enabled
+func (r *TokenRefresher) needsKube() bool {
+	return (r.source == nil && r.Source.name() == SourceTokenRequest) ||
+		r.hasSink(SinkSecret) || r.EKSAnnotations || r.WatchPod || r.TerminationDeadline ||
+		len(r.PrimaryContainers) > 0 || slices.Contains(r.triggerNames(), TriggerPodDeletion)
+}
+
+// monitoredTokenFile returns the token the application currently uses
+func (r *TokenRefresher) monitoredTokenFile() string {
+	if r.hasSink(SinkFile) {
+		return r.TokenFile
 	}
-	return createKubeClient(r.KubeConfig)
+	return r.DefaultTokenFile
 }
 
-func (r TokenRefresher) ensureTarget() error {
+func (r *TokenRefresher) ensureTarget() error {
 	_, err := os.Stat(r.DefaultTokenFile)
 	if err != nil {
 		return fmt.Errorf("unable to access default token at %s: %w", r.DefaultTokenFile, err)
 	}
 	_, err = os.Stat(r.TokenFile)
 	if err == nil {
-		fmt.Printf("Target already exists: %s\n", r.TokenFile)
+		r.log().Infof("Target already exists: %s", r.TokenFile)
 		return nil
 	}
 	err = os.Symlink(r.DefaultTokenFile, r.TokenFile)
 	if err != nil {
 		return fmt.Errorf("unable to symlink %s -> %s: %w", r.TokenFile, r.DefaultTokenFile, err)
 	}
-	fmt.Printf("Created link: %s -> %s\n", r.TokenFile, r.DefaultTokenFile)
+	r.log().Infof("Created link: %s -> %s", r.TokenFile, r.DefaultTokenFile)
 	return nil
 }
 
-// waitForTrigger blocks until it either receives a shutdown signal or detects an invalid token
-// token-refresher spends most of its time here - waiting for the trigger
-func (r TokenRefresher) waitForTrigger(stopCh <-chan struct{}) {
-	fmt.Println("Waiting for shutdown signal and monitoring token expiry")
-	ch := r.monitorToken(stopCh)
-	for {
-		select {
-		case <-stopCh:
-			fmt.Println("Shutdown signal received - Ignoring")
-			return
-		case msg := <-ch:
-			fmt.Println(msg)
-			return
-		}
-	}
-}
-
-func (r TokenRefresher) monitorToken(stopCh <-chan struct{}) <-chan string {
-	ticker := ticker.NewTicker(r.RefreshInterval)
-	ch := make(chan string)
-	go func() {
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				if !readTokenAndValidate(r.TokenFile, r.minExpiryDuration) {
-					ch <- "Invalid/expired token detected"
-					return
-				}
-				if r.shouldShutdown() {
-					ch <- "Shutdown file detected while monitoring token"
-					return
-				}
-			case <-stopCh:
-				return
-			}
-		}
-	}()
-	return ch
-}
-
-func (r TokenRefresher) refreshLoop(client kubernetes.Interface) {
-	fmt.Println("Starting refresh loop")
-	fmt.Printf("Will refresh every %v\n", r.RefreshInterval)
-	fmt.Printf("Will check for shutdown file every %v\n", r.ShutdownInterval)
-	refreshTicker := ticker.NewTicker(r.RefreshInterval)
-	shutdownTicker := ticker.NewTicker(r.ShutdownInterval)
+// refreshLoop refreshes tokens until a stop condition is met or stop is closed
+func (r *TokenRefresher) refreshLoop(client kubernetes.Interface, stop <-chan struct{}) ExitReason {
+	r.log().Infof("Starting refresh loop")
+	r.log().Infof("Will refresh every %v", r.refreshInterval())
+	r.log().Infof("Will check for shutdown file every %v", r.shutdownInterval())
+	refreshTicker := ticker.NewTicker(r.refreshInterval())
+	shutdownTicker := ticker.NewTicker(r.shutdownInterval())
 	defer refreshTicker.Stop()
 	defer shutdownTicker.Stop()
+	reloaded := r.reloadedCh()
+	done := make(chan struct{})
+	defer close(done)
+	stopCh := r.watchStop(client, done)
+	force := r.forceCh()
 	for {
 		select {
+		case reason := <-stopCh:
+			r.log().Infof("%s", reason.Message)
+			return reason
+
+		case <-stop:
+			r.log().Infof("Stop signal received")
+			return ExitReason{Kind: ExitStopped, Message: "Stop signal received"}
+
+		case <-reloaded:
+			reloaded = r.reloadedCh()
+			r.log().Infof("Will refresh every %v", r.refreshInterval())
+			r.log().Infof("Will check for shutdown file every %v", r.shutdownInterval())
+			refreshTicker.Reset(r.refreshInterval())
+			r.setNextRefresh(r.now().Add(r.refreshInterval()))
+			shutdownTicker.Reset(r.shutdownInterval())
+
 		case <-refreshTicker.C:
-			err := r.Retryer.Do(func() (error, bool) {
-				return r.refresh(client), true
-			})
-			if err != nil {
-				fmt.Printf("unable to refresh token: %s\n", err.Error())
-				continue
+			r.setNextRefresh(r.now().Add(r.refreshInterval()))
+			if reason, stopped := r.refreshTick(client); stopped {
+				return reason
+			}
+
+		case <-force:
+			r.log().Infof("Refreshing token on request")
+			if reason, stopped := r.refreshTick(client); stopped {
+				return reason
 			}
-			fmt.Println("Refreshed token")
 
 		case <-shutdownTicker.C:
+			r.checkHeartbeat()
+			if reason, expired := r.heartbeatExpired(); expired {
+				return reason
+			}
+			if r.deadlinePassed() {
+				return r.deadlineReached()
+			}
 			if r.shouldShutdown() {
-				fmt.Println("Shutdown signal detected")
-				if err := os.Remove(r.shutdownFile); err != nil {
-					fmt.Printf("unable to remove shutdown file: %s\n", err.Error())
-				}
-				return
+				r.log().Infof("Shutdown signal detected")
+				r.removeShutdownFiles()
+				return ExitReason{Kind: ExitShutdownFile, Message: "Shutdown signal detected"}
 			}
 		}
 	}
 }
 
-func (r TokenRefresher) refresh(client kubernetes.Interface) error {
-	token, err := r.createToken(client)
+func (r *TokenRefresher) deadlineReached() ExitReason {
+	msg := fmt.Sprintf("Termination deadline %s has passed", r.deadline.Format(time.RFC3339))
+	r.log().Infof("%s", msg)
+	return ExitReason{Kind: ExitDeadline, Message: msg}
+}
+
+// refreshTick refreshes the token with retries unless the termination deadline or the heartbeat prevent it.
+// Returns true along with the reason if the refresh loop should end.
+func (r *TokenRefresher) refreshTick(client kubernetes.Interface) (ExitReason, bool) {
+	if r.TerminationDeadline {
+		r.updateDeadline(client, false)
+		if r.deadlinePassed() {
+			return r.deadlineReached(), true
+		}
+		if err := r.checkDeadline(); err != nil {
+			r.log().Infof("Not refreshing token: %s", err.Error())
+			return ExitReason{}, false
+		}
+	}
+	if !r.checkHeartbeat() {
+		return ExitReason{}, false
+	}
+	attempt := 0
+	var token string
+	err := r.retryer().DoWithLogger(r.log(), func() (error, bool) {
+		attempt++
+		r.setRetryAttempt(attempt)
+		var err error
+		token, err = r.refreshToken(client)
+		return err, true
+	})
+	r.setRetryAttempt(0)
 	if err != nil {
-		return err
+		result := RefreshResult{Time: r.now(), Error: err.Error()}
+		var de *deliveryError
+		if errors.As(err, &de) {
+			result.Sinks = de.results
+		}
+		r.setLastRefresh(result)
+		r.log().Errorf("unable to refresh token: %s", err.Error())
+		for _, f := range r.callbacks.onError {
+			f(err)
+		}
+		return ExitReason{}, false
 	}
-	if !isTokenValid(token, r.minExpiryDuration) {
-		return fmt.Errorf("invalid token from server")
+	r.log().Infof("Refreshed token")
+	if len(r.callbacks.onRefresh) > 0 {
+		expiresAt, _ := tokenExpiry(token)
+		info := TokenInfo{Token: token, ExpiresAt: expiresAt, Audiences: r.TokenAudience, Attempt: attempt}
+		for _, f := range r.callbacks.onRefresh {
+			f(info)
+		}
 	}
-	return safeWrite(r.TokenFile, token)
+	return ExitReason{}, false
 }
 
-func (r TokenRefresher) createToken(client kubernetes.Interface) (string, error) {
-	expSec := r.ExpirationDuration.Milliseconds() / 1000
-	req := &v1.TokenRequest{
-		Spec: v1.TokenRequestSpec{
-			Audiences:         r.TokenAudience,
-			ExpirationSeconds: &expSec,
-		},
+func (r *TokenRefresher) refresh(client kubernetes.Interface) error {
+	_, err := r.refreshToken(client)
+	return err
+}
+
+// refreshToken creates a token and delivers it to the sinks
+func (r *TokenRefresher) refreshToken(client kubernetes.Interface) (string, error) {
+	expiration, minExpiry := r.boundedExpiration()
+	token, err := r.createToken(client, r.TokenAudience, expiration)
+	if err != nil {
+		return "", err
 	}
-	resp, err := createToken(client, r.Namespace, r.ServiceAccount, req)
+	if !r.isTokenValid(token, minExpiry) {
+		return "", fmt.Errorf("invalid token from the %s source", r.Source.name())
+	}
+	results, err := r.deliver(client, token)
 	if err != nil {
-		return "", fmt.Errorf("unable to create token: %w", err)
+		return "", err
 	}
-	return resp.Status.Token, nil
+	expiresAt, _ := tokenExpiry(token)
+	r.setLastRefresh(RefreshResult{Time: r.now(), ExpiresAt: expiresAt, Sinks: results})
+	r.notify(token, results)
+	return token, nil
 }
 
-func (r TokenRefresher) shouldShutdown() bool {
-	_, err := os.Stat(r.shutdownFile)
+// notify fires the post-refresh hooks, leaving out the token file and the signal if the file sink failed
+func (r *TokenRefresher) notify(token string, results []SinkResult) {
+	if !r.Hooks.Enabled() {
+		return
+	}
+	expiresAt, err := tokenExpiry(token)
 	if err != nil {
-		return false
+		r.log().Errorf("unable to read token expiry for hooks: %s", err.Error())
+	}
+	h := r.Hooks
+	event := hooks.Event{ExpiresAt: expiresAt}
+	for _, result := range results {
+		if result.Name != SinkFile {
+			continue
+		}
+		if result.Error == "" {
+			event.TokenFile = r.TokenFile
+		} else if h.Signal != "" {
+			r.log().Warnf("Skipping hook signal as the token file was not written")
+			h.Signal = ""
+		}
+	}
+	if h.Enabled() {
+		h.Notify(r.log(), event)
 	}
-	fmt.Printf("Shutdown file detected at %s\n", r.shutdownFile)
-	return true
 }
@@ -1,6 +1,7 @@
 package tokenrefresher
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	testclient "k8s.io/client-go/kubernetes/fake"
 	k8stesing "k8s.io/client-go/testing"
@@ -76,7 +78,7 @@ func TestTokenRefresher_waitForTrigger(t *testing.T) {
 		retCh := make(chan struct{})
 
 		go func() {
-			r.waitForTrigger(stopCh)
+			r.waitForTrigger(context.Background(), nil, stopCh)
 			close(retCh)
 		}()
 
@@ -101,7 +103,7 @@ func TestTokenRefresher_waitForTrigger(t *testing.T) {
 		retCh := make(chan struct{})
 
 		go func() {
-			r.waitForTrigger(stopCh)
+			r.waitForTrigger(context.Background(), nil, stopCh)
 			close(retCh)
 		}()
 
@@ -125,7 +127,7 @@ func TestTokenRefresher_waitForTrigger(t *testing.T) {
 		retCh := make(chan struct{})
 
 		go func() {
-			r.waitForTrigger(stopCh)
+			r.waitForTrigger(context.Background(), nil, stopCh)
 			close(retCh)
 		}()
 
@@ -145,7 +147,7 @@ func TestTokenRefresher_waitForTrigger(t *testing.T) {
 		safeWrite(r.shutdownFile, "")
 
 		go func() {
-			r.waitForTrigger(stopCh)
+			r.waitForTrigger(context.Background(), nil, stopCh)
 			close(retCh)
 		}()
 
@@ -173,11 +175,74 @@ func TestTokenRefresher_refresh(t *testing.T) {
 			t.Fatalf("refresh() did not create a valid token: %s", err.Error())
 		}
 
-		if !readTokenAndValidate(r.TokenFile, r.minExpiryDuration) {
+		if !r.readTokenAndValidate(r.TokenFile, r.minExpiryDuration) {
 			t.Fatalf("refresh() created an invalid token file")
 		}
 	})
 
+	t.Run("refresh() should fire hooks after writing the token", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		c := getFakeClient(r, false)
+		out := r.TokenFile + ".hook"
+		r.Hooks.Command = "cp $TOKEN_REFRESHER_TOKEN_FILE " + out
+
+		err := r.refresh(c)
+		if err != nil {
+			t.Fatalf("refresh() did not create a valid token: %s", err.Error())
+		}
+
+		if !r.readTokenAndValidate(out, r.minExpiryDuration) {
+			t.Fatalf("refresh() did not fire hook with the new token")
+		}
+	})
+
+	t.Run("refresh() should not pass the token file to hooks if it was not written", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		out := r.TokenFile + ".hook"
+		r.TokenFile = path.Join(r.TokenFile, "missing", "token")
+		r.Sinks = []string{SinkFile, SinkSecret}
+		r.Sink.Policy = SinkPolicyAny
+		r.Secret = SecretSink{SecretName: "token", SecretKey: "token"}
+		r.Hooks.Command = "echo -n \"$TOKEN_REFRESHER_TOKEN_FILE\" > " + out
+
+		if err := r.refresh(getFakeClient(r, false)); err != nil {
+			t.Fatalf("refresh() failed: %s", err.Error())
+		}
+		if b, err := os.ReadFile(out); err != nil || len(b) != 0 {
+			t.Errorf("want the hook fired without a token file, got %q, %v", b, err)
+		}
+	})
+
+	t.Run("refresh() should write only to the secret if the file sink is disabled", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		want := "this_string_should_not_be_overwritten"
+		safeWrite(r.TokenFile, want)
+		c := getFakeClient(r, false)
+		r.Sinks = []string{SinkSecret}
+		r.Secret = SecretSink{SecretName: "token", SecretKey: "token"}
+
+		err := r.refresh(c)
+		if err != nil {
+			t.Fatalf("refresh() failed: %s", err.Error())
+		}
+
+		secret, err := c.CoreV1().Secrets(r.Namespace).Get(context.TODO(), "token", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("refresh() did not create the secret: %s", err.Error())
+		}
+		if !r.isTokenValid(string(secret.Data["token"]), r.minExpiryDuration) {
+			t.Errorf("refresh() wrote an invalid token to the secret")
+		}
+		got, _ := os.ReadFile(r.TokenFile)
+		if want != string(got) {
+			t.Errorf("want: %s, got %s", want, string(got))
+		}
+	})
+
 	t.Run("refresh() should fail and skip updating token in case of errors", func(t *testing.T) {
 		r, cleanup := setup()
 		defer cleanup()
@@ -209,7 +274,7 @@ func TestTokenRefresher_refreshLoop(t *testing.T) {
 		retCh := make(chan struct{})
 
 		go func() {
-			r.refreshLoop(c)
+			r.refreshLoop(c, nil)
 			close(retCh)
 		}()
 
@@ -229,6 +294,27 @@ func TestTokenRefresher_refreshLoop(t *testing.T) {
 			t.Errorf("refreshLoop() did not delete the shutdown file on exit")
 		}
 	})
+
+	t.Run("refreshLoop() should exit when stopped", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		c := getFakeClient(r, false)
+		stop := make(chan struct{})
+		retCh := make(chan struct{})
+
+		go func() {
+			r.refreshLoop(c, stop)
+			close(retCh)
+		}()
+
+		close(stop)
+		select {
+		case <-retCh:
+		case <-time.After(r.RefreshInterval * 2):
+			t.Errorf("refreshLoop() did not return after being stopped")
+		}
+	})
 }
 
 func setup() (*TokenRefresher, func()) {
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	v1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -29,56 +30,77 @@ func createKubeClient(kubeconfig string) (*kubernetes.Clientset, error) {
 	return kubernetes.NewForConfig(config)
 }
 
-func createToken(client kubernetes.Interface, ns, sa string, req *v1.TokenRequest) (*v1.TokenRequest, error) {
+func createToken(ctx context.Context, client kubernetes.Interface, ns, sa string, req *v1.TokenRequest) (*v1.TokenRequest, error) {
 	return client.CoreV1().
 		ServiceAccounts(ns).
-		CreateToken(context.TODO(), sa, req, metav1.CreateOptions{})
+		CreateToken(ctx, sa, req, metav1.CreateOptions{})
 }
 
-func readTokenAndValidate(tokenFile string, minExp time.Duration) bool {
+func getPod(client kubernetes.Interface, ns, name string) (*corev1.Pod, error) {
+	pod, err := client.CoreV1().Pods(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get pod %s/%s: %w", ns, name, err)
+	}
+	return pod, nil
+}
+
+func (r *TokenRefresher) readTokenAndValidate(tokenFile string, minExp time.Duration) bool {
 	b, err := os.ReadFile(tokenFile)
 	if err != nil {
-		fmt.Printf("unable to read file %s: %s\n", tokenFile, err.Error())
+		r.log().Errorf("unable to read file %s: %s", tokenFile, err.Error())
 		return false
 	}
-	return isTokenValid(string(b), minExp)
+	return r.isTokenValid(string(b), minExp)
 }
 
 // isTokenValid checks if the `exp` key in the claims of the jwt is valid for at least the given duration
-func isTokenValid(token string, minExp time.Duration) bool {
-	parts := strings.Split(token, ".")
-	if len(parts) != 3 {
-		fmt.Println("invalid token")
+func (r *TokenRefresher) isTokenValid(token string, minExp time.Duration) bool {
+	expiresAt, err := tokenExpiry(token)
+	if err != nil {
+		r.log().Infof("%s", err.Error())
 		return false
 	}
-	data, err := base64.RawURLEncoding.DecodeString(parts[1])
-	if err != nil {
-		fmt.Printf("unable to decode token: %s\n", err.Error())
+	expiresIn := expiresAt.Sub(r.now())
+	if expiresIn < 0 {
+		r.log().Warnf("token has expired at %v (%v ago)", expiresAt, -expiresIn)
 		return false
 	}
-	var claims map[string]interface{}
-	err = json.Unmarshal(data, &claims)
-	if err != nil {
-		fmt.Printf("unable to decode json: %s\n", err.Error())
+	if expiresIn < minExp {
+		r.log().Warnf("token too old, expires at %v (in %v)", expiresAt, expiresIn)
 		return false
 	}
+	return true
+}
+
+// tokenExpiry returns the time given by the `exp` key in the claims of the jwt
+func tokenExpiry(token string) (time.Time, error) {
+	claims, err := parseClaims(token)
+	if err != nil {
+		return time.Time{}, err
+	}
 	exp, ok := claims["exp"].(float64)
 	if !ok {
-		fmt.Printf("exp not a number: %v", claims["exp"])
-		return false
+		return time.Time{}, fmt.Errorf("exp not a number: %v", claims["exp"])
 	}
-	expiresAt := time.Unix(int64(exp), 0)
-	expiresIn := time.Until(expiresAt)
-	if expiresIn < 0 {
-		fmt.Printf("token has expired at %v (%v ago)\n", expiresAt, -expiresIn)
-		return false
+	return time.Unix(int64(exp), 0), nil
+}
+
+// parseClaims decodes the claims of the jwt without verifying its signature
+func parseClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid token")
 	}
-	if expiresIn < minExp {
-		fmt.Printf("token too old, expires at %v (in %v)\n", expiresAt, expiresIn)
-		return false
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode token: %w", err)
 	}
-	// fmt.Printf("token is valid, expires at %v (in %v)\n", expiresAt, expiresIn)
-	return true
+	var claims map[string]interface{}
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode json: %w", err)
+	}
+	return claims, nil
 }
 
 // safeWrite first writes to a temp file and then switches it with the target file atomically by renaming
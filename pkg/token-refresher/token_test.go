@@ -56,7 +56,7 @@ func Test_isTokenValid(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := isTokenValid(tt.args.token, time.Minute*90); got != tt.want {
+			if got := (&TokenRefresher{}).isTokenValid(tt.args.token, time.Minute*90); got != tt.want {
 				t.Errorf("isTokenValid() = %v, want %v", got, tt.want)
 			}
 		})
@@ -0,0 +1,333 @@
+package tokenrefresher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxMintedTokens caps the tokens minted on demand for other audiences which are cached
+const maxMintedTokens = 32
+
+// tokenWatchTimeout is how long GET /token/watch waits for a new token unless the timeout parameter is set
+var tokenWatchTimeout = 5 * time.Minute
+
+// TokenAPISettings configure the token API, which is disabled unless an address is set
+type TokenAPISettings struct {
+	// Addr is a Unix socket, or a loopback address if AllowTCP is set, as peers can only be checked on a socket
+	Addr     string `mapstructure:"token_api_addr"`
+	AllowTCP bool   `mapstructure:"token_api_allow_tcp"`
+	// UIDs are the users allowed to connect, defaults to the refresher's own
+	UIDs []int `mapstructure:"token_api_uids"`
+	// Audiences are the audiences tokens can be minted for on demand besides the configured ones
+	Audiences []string `mapstructure:"token_api_audiences"`
+}
+
+func (a *TokenAPISettings) enabled() bool {
+	return a.Addr != ""
+}
+
+func (a *TokenAPISettings) validate() error {
+	if !a.enabled() {
+		return nil
+	}
+	if err := validateLocalAddr("token API", a.Addr); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(a.Addr, unixPrefix) && !a.AllowTCP {
+		return fmt.Errorf("token API address %s must be a unix socket unless tcp is allowed", a.Addr)
+	}
+	if len(a.UIDs) > 0 && !strings.HasPrefix(a.Addr, unixPrefix) {
+		return fmt.Errorf("token API uids can only be checked on a unix socket")
+	}
+	if len(a.Audiences) > 0 && !strings.HasPrefix(a.Addr, unixPrefix) {
+		return fmt.Errorf("token API audiences can only be served on a unix socket")
+	}
+	return nil
+}
+
+func (a *TokenAPISettings) allowedUIDs() []int {
+	if len(a.UIDs) > 0 {
+		return a.UIDs
+	}
+	return []int{os.Getuid()}
+}
+
+// tokenCache holds the latest token and those minted on demand for other audiences
+type tokenCache struct {
+	mu      sync.Mutex
+	token   string
+	updated chan struct{}
+	minted  map[string]string
+	// minting serializes on-demand minting, so that concurrent requests do not each mint a token
+	minting sync.Mutex
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{updated: make(chan struct{}), minted: map[string]string{}}
+}
+
+// set stores the latest token and wakes up the watchers
+func (c *tokenCache) set(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+	close(c.updated)
+	c.updated = make(chan struct{})
+}
+
+// get returns the latest token and a channel which is closed once it is replaced
+func (c *tokenCache) get() (string, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token, c.updated
+}
+
+func (c *tokenCache) getMinted(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.minted[key]
+}
+
+// setMinted caches a token minted on demand, evicting expired ones and the first to expire once it is full
+func (c *tokenCache) setMinted(key, token string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, t := range c.minted {
+		if expiresAt, err := tokenExpiry(t); err != nil || !expiresAt.After(now) {
+			delete(c.minted, k)
+		}
+	}
+	if _, ok := c.minted[key]; !ok && len(c.minted) >= maxMintedTokens {
+		var first string
+		var firstExpiry time.Time
+		for k, t := range c.minted {
+			expiresAt, _ := tokenExpiry(t)
+			if first == "" || expiresAt.Before(firstExpiry) {
+				first, firstExpiry = k, expiresAt
+			}
+		}
+		delete(c.minted, first)
+	}
+	c.minted[key] = token
+}
+
+// tokenResponse is the body of the token API's responses
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// serveTokenAPI serves the token API until the returned function is called
+func (r *TokenRefresher) serveTokenAPI(client kubernetes.Interface) (func(), error) {
+	l, err := listenLocal(r.TokenAPI.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on token API address %s: %w", r.TokenAPI.Addr, err)
+	}
+	r.tokens = newTokenCache()
+	srv := &http.Server{Handler: r.tokenAPIHandler(client), ConnContext: withPeerUID}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			r.log().Errorf("unable to serve token API on %s: %s", r.TokenAPI.Addr, err.Error())
+		}
+	}()
+	if !strings.HasPrefix(r.TokenAPI.Addr, unixPrefix) {
+		r.log().Warnf("Token API on %s serves the token to every process in the pod, use a unix socket to check their uid", r.TokenAPI.Addr)
+	}
+	r.log().Infof("Serving token API on %s", r.TokenAPI.Addr)
+	return func() { srv.Close() }, nil
+}
+
+func (r *TokenRefresher) tokenAPIHandler(client kubernetes.Interface) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		auds := audiences(req)
+		if aud, ok := r.allowedAudiences(auds); !ok {
+			r.log().Warnf("Rejected token API request for audience %s", aud)
+			http.Error(w, fmt.Sprintf("audience %s is not allowed", aud), http.StatusForbidden)
+			return
+		}
+		if len(auds) > 0 && audienceKey(auds) != audienceKey(r.TokenAudience) && !r.mintsAudiences() {
+			http.Error(w, fmt.Sprintf("the %s source cannot mint tokens for other audiences", r.Source.name()), http.StatusBadRequest)
+			return
+		}
+		token, err := r.currentToken(client, auds)
+		if err != nil {
+			r.log().Errorf("unable to serve token: %s", err.Error())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		r.writeToken(w, token)
+	})
+	mux.HandleFunc("/token/watch", func(w http.ResponseWriter, req *http.Request) {
+		if len(audiences(req)) > 0 {
+			http.Error(w, "only tokens for the default audience can be watched", http.StatusBadRequest)
+			return
+		}
+		timeout := tokenWatchTimeout
+		if t := req.URL.Query().Get("timeout"); t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = min(d, tokenWatchTimeout)
+		}
+		_, updated := r.tokens.get()
+		select {
+		case <-updated:
+			token, _ := r.tokens.get()
+			r.writeToken(w, token)
+		case <-time.After(timeout):
+			w.WriteHeader(http.StatusNoContent)
+		case <-req.Context().Done():
+		}
+	})
+	return r.checkPeer(getOnly(mux))
+}
+
+// checkPeer rejects connections on a Unix socket from users which are not allowed
+func (r *TokenRefresher) checkPeer(h http.Handler) http.Handler {
+	if !strings.HasPrefix(r.TokenAPI.Addr, unixPrefix) {
+		return h
+	}
+	allowed := r.TokenAPI.allowedUIDs()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		uid, ok := req.Context().Value(peerUIDKey{}).(int)
+		if !ok || !slices.Contains(allowed, uid) {
+			r.log().Warnf("Rejected token API request from uid %v", req.Context().Value(peerUIDKey{}))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func getOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// allowedAudiences returns the first of the audiences which tokens cannot be served for, if any
+func (r *TokenRefresher) allowedAudiences(auds []string) (string, bool) {
+	for _, aud := range auds {
+		if !slices.Contains(r.TokenAudience, aud) && !slices.Contains(r.TokenAPI.Audiences, aud) {
+			return aud, false
+		}
+	}
+	return "", true
+}
+
+// audiences returns the comma separated audiences of the request, if any
+func audiences(req *http.Request) []string {
+	var auds []string
+	for _, a := range strings.Split(req.URL.Query().Get("audience"), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			auds = append(auds, a)
+		}
+	}
+	return auds
+}
+
+func (r *TokenRefresher) writeToken(w http.ResponseWriter, token string) {
+	expiresAt, _ := tokenExpiry(token)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(tokenResponse{Token: token, ExpiresAt: expiresAt}); err != nil {
+		r.log().Errorf("unable to write token: %s", err.Error())
+	}
+}
+
+// currentToken returns the token for the audiences, minting one on demand if it is close to expiry
+func (r *TokenRefresher) currentToken(client kubernetes.Interface, auds []string) (string, error) {
+	key := audienceKey(auds)
+	isDefault := key == "" || key == audienceKey(r.TokenAudience)
+	// close to the termination deadline, tokens are cut to it and so are only required to last until then
+	expiration, minExpiry := r.boundedExpiration()
+	token := r.latestToken(isDefault, key)
+	if token != "" && r.isTokenValid(token, minExpiry) {
+		return token, nil
+	}
+
+	r.tokens.minting.Lock()
+	defer r.tokens.minting.Unlock()
+	// another request may have minted one meanwhile
+	if token := r.latestToken(isDefault, key); token != "" && r.isTokenValid(token, minExpiry) {
+		return token, nil
+	}
+	if err := r.checkMint(); err != nil {
+		return "", err
+	}
+	if isDefault {
+		auds = r.TokenAudience
+	}
+	token, err := r.createToken(client, auds, expiration)
+	if err != nil {
+		return "", err
+	}
+	if !r.isTokenValid(token, minExpiry) {
+		return "", fmt.Errorf("invalid token from the %s source", r.Source.name())
+	}
+	r.log().Infof("Minted token for audience %q on demand", key)
+	if isDefault {
+		r.tokens.set(token)
+	} else {
+		r.tokens.setMinted(key, token, r.now())
+	}
+	return token, nil
+}
+
+// checkMint returns an error wherever the refresh loop would not refresh a token either
+func (r *TokenRefresher) checkMint() error {
+	if err := r.checkDeadline(); err != nil {
+		return err
+	}
+	if !r.Heartbeat.enabled() {
+		return nil
+	}
+	if age, stale := r.Heartbeat.stale(r.now()); stale {
+		return fmt.Errorf("no heartbeat from the app for %v, which is longer than %v", age.Truncate(time.Second), r.Heartbeat.Window)
+	}
+	return nil
+}
+
+// latestToken returns the cached token for the audiences, or the token file if it is newer
+func (r *TokenRefresher) latestToken(isDefault bool, key string) string {
+	if !isDefault {
+		return r.tokens.getMinted(key)
+	}
+	token, _ := r.tokens.get()
+	b, err := os.ReadFile(r.monitoredTokenFile())
+	if err != nil {
+		return token
+	}
+	fileExpiry, err := tokenExpiry(string(b))
+	if err != nil {
+		return token
+	}
+	if cachedExpiry, err := tokenExpiry(token); err != nil || fileExpiry.After(cachedExpiry) {
+		return string(b)
+	}
+	return token
+}
+
+// audienceKey identifies a set of audiences regardless of their order
+func audienceKey(auds []string) string {
+	sorted := slices.Clone(auds)
+	slices.Sort(sorted)
+	return strings.Join(sorted, ",")
+}
@@ -0,0 +1,291 @@
+package tokenrefresher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesing "k8s.io/client-go/testing"
+)
+
+func TestTokenAPISettings_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     TokenAPISettings
+		wantErr bool
+	}{
+		{name: "disabled"},
+		{name: "loopback", api: TokenAPISettings{Addr: "localhost:8084"}, wantErr: true},
+		{name: "loopback with tcp allowed", api: TokenAPISettings{Addr: "localhost:8084", AllowTCP: true}},
+		{name: "socket with uids", api: TokenAPISettings{Addr: "unix:/run/token.sock", UIDs: []int{1000}}},
+		{name: "any interface", api: TokenAPISettings{Addr: ":8084", AllowTCP: true}, wantErr: true},
+		{name: "uids on tcp", api: TokenAPISettings{Addr: "localhost:8084", AllowTCP: true, UIDs: []int{1000}}, wantErr: true},
+		{name: "socket with audiences", api: TokenAPISettings{Addr: "unix:/run/token.sock", Audiences: []string{"vault"}}},
+		{name: "audiences on tcp", api: TokenAPISettings{Addr: "localhost:8084", AllowTCP: true, Audiences: []string{"vault"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.api.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func getToken(t *testing.T, h http.Handler, target string) (int, tokenResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	var resp tokenResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unable to decode token response: %s", err.Error())
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestTokenRefresher_tokenAPIHandler(t *testing.T) {
+	t.Run("GET /token should serve the token file while it is valid", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		token := getTokenWithExpiry(time.Hour * 2)
+		safeWrite(r.TokenFile, token)
+		r.tokens = newTokenCache()
+
+		code, resp := getToken(t, r.tokenAPIHandler(getFakeClient(r, true)), "/token")
+		if code != http.StatusOK || resp.Token != token {
+			t.Errorf("want the token file with status 200, got status %d", code)
+		}
+		if resp.ExpiresAt.IsZero() {
+			t.Errorf("want the expiry of the token")
+		}
+	})
+
+	t.Run("GET /token should mint a token on demand when close to expiry", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, getTokenWithExpiry(time.Minute))
+		r.tokens = newTokenCache()
+		h := r.tokenAPIHandler(getFakeClient(r, false))
+
+		code, resp := getToken(t, h, "/token")
+		if code != http.StatusOK {
+			t.Fatalf("want status 200, got %d", code)
+		}
+		if left := time.Until(resp.ExpiresAt); left < r.ExpirationDuration-time.Minute {
+			t.Errorf("want a token minted on demand, got one expiring in %v", left)
+		}
+		if cached, _ := r.tokens.get(); cached != resp.Token {
+			t.Errorf("token minted on demand was not cached")
+		}
+	})
+
+	t.Run("GET /token should mint a token cut to the termination deadline only once", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, getTokenWithExpiry(time.Minute))
+		r.tokens = newTokenCache()
+		r.deadline = time.Now().Add(r.minExpiryDuration / 3)
+		minted := 0
+		c := testclient.NewSimpleClientset()
+		c.PrependReactor("create", "serviceaccounts", func(action k8stesing.Action) (bool, runtime.Object, error) {
+			minted++
+			ret := action.(k8stesing.CreateActionImpl).GetObject().DeepCopyObject().(*authv1.TokenRequest)
+			ret.Status.Token = getTokenWithExpiry(time.Duration(*ret.Spec.ExpirationSeconds) * time.Second)
+			return true, ret, nil
+		})
+		h := r.tokenAPIHandler(c)
+
+		for i := 0; i < 2; i++ {
+			if code, _ := getToken(t, h, "/token"); code != http.StatusOK {
+				t.Fatalf("want status 200, got %d", code)
+			}
+		}
+		if minted != 1 {
+			t.Errorf("want one token minted, got %d", minted)
+		}
+	})
+
+	t.Run("GET /token should not mint a token when the refresh loop would not refresh one", func(t *testing.T) {
+		for name, modify := range map[string]func(r *TokenRefresher){
+			"termination deadline": func(r *TokenRefresher) { r.deadline = time.Now().Add(MinExpirationDuration / 2) },
+			"stale heartbeat": func(r *TokenRefresher) {
+				r.Heartbeat = Heartbeat{File: r.TokenFile + ".heartbeat", Window: time.Minute, last: time.Now().Add(-2 * time.Minute)}
+			},
+		} {
+			r, cleanup := setup()
+			safeWrite(r.TokenFile, getTokenWithExpiry(time.Minute))
+			r.tokens = newTokenCache()
+			modify(r)
+
+			if code, _ := getToken(t, r.tokenAPIHandler(getFakeClient(r, false)), "/token"); code != http.StatusServiceUnavailable {
+				t.Errorf("want status 503 with a %s, got %d", name, code)
+			}
+			if cached, _ := r.tokens.get(); cached != "" {
+				t.Errorf("want no token minted with a %s", name)
+			}
+			cleanup()
+		}
+	})
+
+	t.Run("GET /token should mint tokens for other audiences", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, getTokenWithExpiry(time.Hour*2))
+		r.tokens = newTokenCache()
+		r.TokenAPI.Audiences = []string{"vault", "sts"}
+		var requested []string
+		c := testclient.NewSimpleClientset()
+		c.PrependReactor("create", "serviceaccounts", func(action k8stesing.Action) (bool, runtime.Object, error) {
+			ret := action.(k8stesing.CreateActionImpl).GetObject().DeepCopyObject().(*authv1.TokenRequest)
+			requested = ret.Spec.Audiences
+			ret.Status.Token = getTokenWithExpiry(time.Duration(*ret.Spec.ExpirationSeconds) * time.Second)
+			return true, ret, nil
+		})
+		h := r.tokenAPIHandler(c)
+
+		code, first := getToken(t, h, "/token?audience=vault,sts")
+		if code != http.StatusOK {
+			t.Fatalf("want status 200, got %d", code)
+		}
+		if len(requested) != 2 || requested[0] != "vault" || requested[1] != "sts" {
+			t.Errorf("want audiences [vault sts], got %v", requested)
+		}
+		requested = nil
+		if _, second := getToken(t, h, "/token?audience=sts,vault"); second.Token != first.Token || requested != nil {
+			t.Errorf("token for the same audiences was not cached")
+		}
+	})
+
+	t.Run("GET /token should reject audiences which are not allowed", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.tokens = newTokenCache()
+		r.TokenAudience = []string{"app"}
+		r.TokenAPI.Audiences = []string{"vault"}
+		minted := false
+		c := testclient.NewSimpleClientset()
+		c.PrependReactor("create", "serviceaccounts", func(action k8stesing.Action) (bool, runtime.Object, error) {
+			minted = true
+			return true, nil, fmt.Errorf("not allowed")
+		})
+		h := r.tokenAPIHandler(c)
+
+		for _, target := range []string{"/token?audience=https://kubernetes.default.svc", "/token?audience=vault,other"} {
+			if code, _ := getToken(t, h, target); code != http.StatusForbidden {
+				t.Errorf("want status 403 for %s, got %d", target, code)
+			}
+		}
+		if minted {
+			t.Errorf("want no token minted for audiences which are not allowed")
+		}
+	})
+
+	t.Run("GET /token/watch should return once a new token is written", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		safeWrite(r.TokenFile, "")
+		r.tokens = newTokenCache()
+		h := r.tokenAPIHandler(getFakeClient(r, false))
+		done := make(chan tokenResponse)
+
+		go func() {
+			code, resp := getToken(t, h, "/token/watch")
+			if code != http.StatusOK {
+				t.Errorf("want status 200, got %d", code)
+			}
+			done <- resp
+		}()
+		time.Sleep(50 * time.Millisecond)
+		if err := r.refresh(getFakeClient(r, false)); err != nil {
+			t.Fatalf("refresh() failed: %s", err.Error())
+		}
+		select {
+		case resp := <-done:
+			if b, _ := os.ReadFile(r.TokenFile); resp.Token != string(b) {
+				t.Errorf("want the refreshed token")
+			}
+		case <-time.After(time.Second):
+			t.Errorf("GET /token/watch did not return after a refresh")
+		}
+	})
+
+	t.Run("GET /token/watch should time out without a new token", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		r.tokens = newTokenCache()
+
+		if code, _ := getToken(t, r.tokenAPIHandler(nil), "/token/watch?timeout=10ms"); code != http.StatusNoContent {
+			t.Errorf("want status 204, got %d", code)
+		}
+	})
+}
+
+func TestTokenCache_setMinted(t *testing.T) {
+	c := newTokenCache()
+	now := time.Now()
+	c.setMinted("expired", getTokenWithExpiry(-time.Minute), now)
+	c.setMinted("first", getTokenWithExpiry(time.Minute), now)
+	for i := 0; i < maxMintedTokens; i++ {
+		c.setMinted(fmt.Sprintf("aud-%d", i), getTokenWithExpiry(time.Hour), now)
+	}
+
+	if len(c.minted) != maxMintedTokens {
+		t.Errorf("want the cache capped at %d tokens, got %d", maxMintedTokens, len(c.minted))
+	}
+	if c.getMinted("expired") != "" || c.getMinted("first") != "" {
+		t.Errorf("want the expired token and the one expiring first evicted")
+	}
+	if c.getMinted(fmt.Sprintf("aud-%d", maxMintedTokens-1)) == "" {
+		t.Errorf("want the latest token cached")
+	}
+}
+
+func TestTokenRefresher_serveTokenAPI(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		uid      int
+		wantCode int
+	}{
+		{name: "allowed uid", uid: os.Getuid(), wantCode: http.StatusOK},
+		{name: "other uid", uid: os.Getuid() + 1, wantCode: http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, cleanup := setup()
+			defer cleanup()
+			safeWrite(r.TokenFile, getTokenWithExpiry(time.Hour*2))
+			socket := path.Join(t.TempDir(), "token.sock")
+			r.TokenAPI = TokenAPISettings{Addr: unixPrefix + socket, UIDs: []int{tt.uid}}
+
+			closeAPI, err := r.serveTokenAPI(nil)
+			if err != nil {
+				t.Fatalf("serveTokenAPI() failed: %s", err.Error())
+			}
+			defer closeAPI()
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			}}
+			resp, err := client.Get("http://token/token")
+			if err != nil {
+				t.Fatalf("unable to get token: %s", err.Error())
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("want status %d, got %d", tt.wantCode, resp.StatusCode)
+			}
+		})
+	}
+}
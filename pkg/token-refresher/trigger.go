@@ -0,0 +1,438 @@
+package tokenrefresher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/cron"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/logger"
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/ticker"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Built-in triggers
+const (
+	TriggerSignal      = "signal"
+	TriggerTokenExpiry = "token_expiry"
+	TriggerFile        = "file"
+	TriggerHTTP        = "http"
+	TriggerPodDeletion = "pod_deletion"
+	TriggerSchedule    = "schedule"
+)
+
+// Trigger policies
+const (
+	TriggerPolicyAny = "any"
+	TriggerPolicyAll = "all"
+)
+
+// DefaultTriggers are used if no triggers are configured
+var DefaultTriggers = []string{TriggerSignal, TriggerTokenExpiry, TriggerFile}
+
+// Trigger tells the refresher to leave the passive phase and start refreshing tokens
+type Trigger interface {
+	// Watch sends the reason on the returned channel once the trigger fires.
+	// It must stop watching and release its resources when stopCh is closed.
+	Watch(stopCh <-chan struct{}) <-chan string
+}
+
+// TriggerFunc adapts a function to the Trigger interface
+type TriggerFunc func(stopCh <-chan struct{}) <-chan string
+
+func (f TriggerFunc) Watch(stopCh <-chan struct{}) <-chan string {
+	return f(stopCh)
+}
+
+// TriggerEnv is what a trigger can be built from
+type TriggerEnv struct {
+	Refresher *TokenRefresher
+	Client    kubernetes.Interface
+	// Signal is closed on receiving a shutdown signal
+	Signal <-chan struct{}
+}
+
+// TriggerFactory builds a trigger. It is called every time the refresher enters the passive phase.
+type TriggerFactory func(env TriggerEnv) (Trigger, error)
+
+// TriggerSettings choose the triggers and how they combine
+type TriggerSettings struct {
+	Names  []string `mapstructure:"triggers"`
+	Policy string   `mapstructure:"trigger_policy"`
+	// File is the path watched by the file trigger, defaults to the shutdown file
+	File     string `mapstructure:"trigger_file"`
+	HTTPAddr string `mapstructure:"trigger_http_addr"`
+	// Schedule is either an RFC3339 time or a cron expression
+	Schedule string `mapstructure:"trigger_schedule"`
+}
+
+func (s TriggerSettings) policy() string {
+	if s.Policy == "" {
+		return TriggerPolicyAny
+	}
+	return s.Policy
+}
+
+// builtinTriggers can be enabled by name in the triggers setting. Programs embedding the refresher add their own with WithTrigger.
+var builtinTriggers = map[string]TriggerFactory{
+	TriggerSignal:      newSignalTrigger,
+	TriggerTokenExpiry: newTokenExpiryTrigger,
+	TriggerFile:        newFileTrigger,
+	TriggerHTTP:        newHTTPTrigger,
+	TriggerPodDeletion: newPodDeletionTrigger,
+	TriggerSchedule:    newScheduleTrigger,
+}
+
+// TriggerNames returns the names of the built-in triggers
+func TriggerNames() []string {
+	names := make([]string, 0, len(builtinTriggers))
+	for name := range builtinTriggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupTrigger returns the factory of a trigger added by WithTrigger or of a built-in trigger
+func (r *TokenRefresher) lookupTrigger(name string) (TriggerFactory, bool) {
+	if f, ok := r.customTriggers[name]; ok {
+		return f, true
+	}
+	f, ok := builtinTriggers[name]
+	return f, ok
+}
+
+// triggerNames returns the enabled triggers, adding the pod deletion trigger if the pod is watched
+func (r *TokenRefresher) triggerNames() []string {
+	names := r.Trigger.Names
+	if len(names) == 0 {
+		names = DefaultTriggers
+	}
+	if r.WatchPod && !slices.Contains(names, TriggerPodDeletion) {
+		names = append(slices.Clone(names), TriggerPodDeletion)
+	}
+	return names
+}
+
+func (r *TokenRefresher) validateTriggers() error {
+	var errs []error
+	if p := r.Trigger.policy(); p != TriggerPolicyAny && p != TriggerPolicyAll {
+		errs = append(errs, fmt.Errorf("trigger policy must be %s or %s, got %s", TriggerPolicyAny, TriggerPolicyAll, p))
+	}
+	for _, name := range r.triggerNames() {
+		if _, ok := r.lookupTrigger(name); !ok {
+			errs = append(errs, fmt.Errorf("unknown trigger %s, must be one of %v", name, TriggerNames()))
+		}
+		switch name {
+		case TriggerHTTP:
+			if r.Trigger.HTTPAddr == "" {
+				errs = append(errs, fmt.Errorf("trigger http addr is required for the %s trigger", TriggerHTTP))
+			} else if err := validateLocalAddr("trigger http", r.Trigger.HTTPAddr); err != nil {
+				errs = append(errs, err)
+			}
+		case TriggerPodDeletion:
+			if r.PodName == "" {
+				errs = append(errs, fmt.Errorf("pod name is required for the %s trigger", TriggerPodDeletion))
+			}
+		case TriggerSchedule:
+			if _, err := parseSchedule(r.Trigger.Schedule); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for name := range r.customTriggers {
+		if _, ok := builtinTriggers[name]; ok {
+			errs = append(errs, fmt.Errorf("trigger %s added by WithTrigger conflicts with the built-in trigger", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeTriggers releases the resources of triggers which were set up but are not going to be watched
+func closeTriggers(ts []Trigger) {
+	for _, t := range ts {
+		if c, ok := t.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+type firing struct {
+	name, reason string
+}
+
+// waitForTrigger blocks until the enabled triggers fire according to the trigger policy: any of them or all of them.
+// token-refresher spends most of its time here - waiting for the trigger
+// Returns the names of the triggers which fired, or nil if ctx is done first.
+func (r *TokenRefresher) waitForTrigger(ctx context.Context, client kubernetes.Interface, signal <-chan struct{}) ([]string, error) {
+	names := r.triggerNames()
+	policy := r.Trigger.policy()
+	env := TriggerEnv{Refresher: r, Client: client, Signal: signal}
+	ts := make([]Trigger, 0, len(names))
+	for _, name := range names {
+		f, ok := r.lookupTrigger(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown trigger %s", name)
+		}
+		t, err := f(env)
+		if err != nil {
+			closeTriggers(ts)
+			return nil, fmt.Errorf("unable to set up trigger %s: %w", name, err)
+		}
+		ts = append(ts, t)
+	}
+	r.log().Infof("Waiting for %s of triggers %v", policy, names)
+
+	// done stops the triggers which did not fire
+	done := make(chan struct{})
+	defer close(done)
+	fired := make(chan firing)
+	for i, t := range ts {
+		go func(name string, ch <-chan string) {
+			select {
+			case reason := <-ch:
+				select {
+				case fired <- firing{name, reason}:
+				case <-done:
+				}
+			case <-done:
+			}
+		}(names[i], t.Watch(done))
+	}
+
+	// a forced refresh enters the active phase regardless of the policy, the refresh loop refreshes right away
+	force := r.forceCh()
+	activate := r.activateCh()
+	var firings []firing
+collect:
+	for len(firings) < len(ts) {
+		select {
+		case f := <-fired:
+			r.log().Infof("Trigger %s fired: %s", f.name, f.reason)
+			firings = append(firings, f)
+			if policy == TriggerPolicyAny {
+				break collect
+			}
+		case <-force:
+			firings = []firing{{TriggerManual, "Forced refresh requested"}}
+			break collect
+		case reason := <-activate:
+			firings = []firing{{TriggerManual, reason}}
+			break collect
+		case <-ctx.Done():
+			r.log().Infof("Stop signal received while waiting for triggers")
+			return nil, nil
+		}
+	}
+	firedNames := make([]string, 0, len(firings))
+	reasons := make([]string, 0, len(firings))
+	for _, f := range firings {
+		firedNames = append(firedNames, f.name)
+		reasons = append(reasons, f.name+": "+f.reason)
+	}
+	reason := strings.Join(reasons, "; ")
+	r.log().Infof("Triggered by %s", reason)
+	r.mu.Lock()
+	r.triggerReason = reason
+	r.mu.Unlock()
+	return firedNames, nil
+}
+
+// TriggerReason returns why the refresher entered the active phase, empty while it is still passive
+func (r *TokenRefresher) TriggerReason() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.triggerReason
+}
+
+func newSignalTrigger(env TriggerEnv) (Trigger, error) {
+	return TriggerFunc(func(stopCh <-chan struct{}) <-chan string {
+		ch := make(chan string, 1)
+		go func() {
+			select {
+			case <-env.Signal:
+				ch <- "Shutdown signal received - Ignoring"
+			case <-stopCh:
+			}
+		}()
+		return ch
+	}), nil
+}
+
+func newTokenExpiryTrigger(env TriggerEnv) (Trigger, error) {
+	r := env.Refresher
+	return r.poll(r.refreshInterval, func() (string, bool) {
+		if !r.readTokenAndValidate(r.monitoredTokenFile(), r.minExpiry()) {
+			return "Invalid/expired token detected", true
+		}
+		return "", false
+	}), nil
+}
+
+func newFileTrigger(env TriggerEnv) (Trigger, error) {
+	r := env.Refresher
+	file := r.Trigger.File
+	return r.poll(r.shutdownInterval, func() (string, bool) {
+		if file == "" {
+			if !r.shutdownMarkersPresent() {
+				return "", false
+			}
+			return "Shutdown file detected while monitoring token", true
+		}
+		if _, err := os.Stat(file); err != nil {
+			return "", false
+		}
+		return fmt.Sprintf("File %s detected while monitoring token", file), true
+	}), nil
+}
+
+// poll runs check on every tick of the interval, picking up reloaded intervals, until it reports a reason
+func (r *TokenRefresher) poll(interval func() time.Duration, check func() (string, bool)) Trigger {
+	return TriggerFunc(func(stopCh <-chan struct{}) <-chan string {
+		ticker := ticker.NewTicker(interval())
+		// buffered so that the trigger can exit if another one fired first
+		ch := make(chan string, 1)
+		reloaded := r.reloadedCh()
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-reloaded:
+					reloaded = r.reloadedCh()
+					ticker.Reset(interval())
+				case <-ticker.C:
+					if reason, ok := check(); ok {
+						ch <- reason
+						return
+					}
+				case <-stopCh:
+					return
+				}
+			}
+		}()
+		return ch
+	})
+}
+
+func newPodDeletionTrigger(env TriggerEnv) (Trigger, error) {
+	if env.Client == nil {
+		return nil, fmt.Errorf("no kube client")
+	}
+	// This catches the termination even if the shutdown signal is missed, e.g. when running as a native sidecar.
+	return TriggerFunc(func(stopCh <-chan struct{}) <-chan string {
+		return env.Refresher.watchPod(env.Client, stopCh, podTerminating)
+	}), nil
+}
+
+// httpTrigger fires on a POST to /trigger. An optional reason query parameter is recorded.
+type httpTrigger struct {
+	log   logger.Logger
+	addr  string
+	l     net.Listener
+	fired chan string
+	once  sync.Once
+}
+
+// newHTTPTrigger listens right away, so that an address which cannot be bound fails the refresher
+// instead of leaving a trigger which never fires
+func newHTTPTrigger(env TriggerEnv) (Trigger, error) {
+	addr := env.Refresher.Trigger.HTTPAddr
+	l, err := listenLocal(addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", addr, err)
+	}
+	return &httpTrigger{log: env.Refresher.log(), addr: addr, l: l, fired: make(chan string, 1)}, nil
+}
+
+func (t *httpTrigger) Watch(stopCh <-chan struct{}) <-chan string {
+	mux := http.NewServeMux()
+	mux.Handle("/trigger", t)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(t.l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.log.Errorf("unable to serve %s trigger on %s: %s", TriggerHTTP, t.addr, err.Error())
+		}
+	}()
+	go func() {
+		<-stopCh
+		srv.Close()
+	}()
+	return t.fired
+}
+
+// Close releases the listener of a trigger which is never watched
+func (t *httpTrigger) Close() error {
+	return t.l.Close()
+}
+
+func (t *httpTrigger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reason := "HTTP trigger"
+	// empty on a Unix socket
+	if req.RemoteAddr != "" {
+		reason += " from " + req.RemoteAddr
+	}
+	if q := req.URL.Query().Get("reason"); q != "" {
+		reason += ": " + q
+	}
+	t.once.Do(func() {
+		t.fired <- reason
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// parseSchedule returns a function yielding the next time the schedule trigger fires after the given time
+func parseSchedule(spec string) (func(time.Time) time.Time, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("trigger schedule is required for the %s trigger", TriggerSchedule)
+	}
+	if at, err := time.Parse(time.RFC3339, spec); err == nil {
+		return func(time.Time) time.Time { return at }, nil
+	}
+	s, err := cron.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("trigger schedule must be an RFC3339 time or a cron expression: %w", err)
+	}
+	return s.Next, nil
+}
+
+func newScheduleTrigger(env TriggerEnv) (Trigger, error) {
+	next, err := parseSchedule(env.Refresher.Trigger.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	return TriggerFunc(func(stopCh <-chan struct{}) <-chan string {
+		ch := make(chan string, 1)
+		r := env.Refresher
+		at := next(r.now())
+		if at.IsZero() {
+			r.log().Warnf("trigger schedule %s never fires", env.Refresher.Trigger.Schedule)
+			return ch
+		}
+		r.log().Infof("Scheduled trigger at %s", at.Format(time.RFC3339))
+		go func() {
+			timer := time.NewTimer(at.Sub(r.now()))
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				ch <- fmt.Sprintf("Scheduled time %s reached", at.Format(time.RFC3339))
+			case <-stopCh:
+			}
+		}()
+		return ch
+	}), nil
+}
@@ -0,0 +1,201 @@
+package tokenrefresher
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chanTrigger fires when its channel is closed
+func chanTrigger(ch <-chan struct{}) TriggerFactory {
+	return func(env TriggerEnv) (Trigger, error) {
+		return TriggerFunc(func(stopCh <-chan struct{}) <-chan string {
+			fired := make(chan string, 1)
+			go func() {
+				select {
+				case <-ch:
+					fired <- "closed"
+				case <-stopCh:
+				}
+			}()
+			return fired
+		}), nil
+	}
+}
+
+func TestTokenRefresher_waitForTrigger_policy(t *testing.T) {
+	t.Run("waitForTrigger() should wait for all triggers with the all policy", func(t *testing.T) {
+		r, cleanup := setup()
+		defer cleanup()
+		first, second := make(chan struct{}), make(chan struct{})
+		r.Trigger = TriggerSettings{Policy: TriggerPolicyAll}
+		r.Apply(WithTrigger("test-first", chanTrigger(first)), WithTrigger("test-second", chanTrigger(second)))
+		if err := r.validateTriggers(); err != nil {
+			t.Fatalf("validateTriggers() failed: %s", err.Error())
+		}
+		retCh := make(chan []string)
+
+		go func() {
+			fired, _ := r.waitForTrigger(context.Background(), nil, nil)
+			retCh <- fired
+		}()
+
+		close(first)
+		select {
+		case <-retCh:
+			t.Fatalf("waitForTrigger() returned before all triggers fired")
+		case <-time.After(r.RefreshInterval):
+		}
+		close(second)
+		select {
+		case fired := <-retCh:
+			if !reflect.DeepEqual(fired, []string{"test-first", "test-second"}) {
+				t.Errorf("want fired [test-first test-second], got %v", fired)
+			}
+		case <-time.After(r.RefreshInterval):
+			t.Fatalf("waitForTrigger() did not return after all triggers fired")
+		}
+		if reason := r.TriggerReason(); reason != "test-first: closed; test-second: closed" {
+			t.Errorf("unexpected trigger reason %q", reason)
+		}
+	})
+}
+
+func TestWithTrigger(t *testing.T) {
+	never := chanTrigger(nil)
+	if r := New(WithTrigger("test", never)); !reflect.DeepEqual(r.Trigger.Names, append(slices.Clone(DefaultTriggers), "test")) {
+		t.Errorf("want the trigger enabled next to the default ones, got %v", r.Trigger.Names)
+	}
+	if r := New(WithTriggers(TriggerPolicyAny, "test"), WithTrigger("test", never)); !reflect.DeepEqual(r.Trigger.Names, []string{"test"}) {
+		t.Errorf("want the trigger enabled once, got %v", r.Trigger.Names)
+	}
+	if r := New(); r.customTriggers != nil {
+		t.Errorf("want triggers added to one refresher only")
+	}
+	if err := New(WithTrigger(TriggerFile, never)).validateTriggers(); err == nil || !strings.Contains(err.Error(), "conflicts with the built-in trigger") {
+		t.Errorf("want a trigger shadowing a built-in one rejected, got %v", err)
+	}
+}
+
+func TestTokenRefresher_validateTriggers(t *testing.T) {
+	r := &TokenRefresher{Trigger: TriggerSettings{
+		Names:    []string{TriggerHTTP, TriggerSchedule, TriggerPodDeletion, "unknown"},
+		Policy:   "some",
+		Schedule: "every day",
+	}}
+	err := r.validateTriggers()
+	if err == nil {
+		t.Fatalf("validateTriggers() did not fail")
+	}
+	for _, want := range []string{"trigger policy", "trigger http addr", "trigger schedule", "pod name", "unknown trigger"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error about %s, got %s", want, err.Error())
+		}
+	}
+}
+
+func TestTokenRefresher_validateTriggers_httpAddr(t *testing.T) {
+	for addr, wantErr := range map[string]bool{
+		"localhost:8081":         false,
+		"127.0.0.1:8081":         false,
+		"unix:/tmp/trigger.sock": false,
+		"0.0.0.0:8081":           true,
+		":8081":                  true,
+		"10.0.0.1:8081":          true,
+	} {
+		r := &TokenRefresher{Trigger: TriggerSettings{Names: []string{TriggerHTTP}, HTTPAddr: addr}}
+		if err := r.validateTriggers(); (err != nil) != wantErr {
+			t.Errorf("validateTriggers() with %s error = %v, wantErr %v", addr, err, wantErr)
+		}
+	}
+}
+
+func TestHTTPTrigger_unixSocket(t *testing.T) {
+	socket := path.Join(t.TempDir(), "trigger.sock")
+	r := &TokenRefresher{Trigger: TriggerSettings{HTTPAddr: unixPrefix + socket}}
+	tr, err := newHTTPTrigger(TriggerEnv{Refresher: r})
+	if err != nil {
+		t.Fatalf("newHTTPTrigger() failed: %s", err.Error())
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	fired := tr.Watch(stopCh)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Post("http://token-refresher/trigger", "", nil)
+	if err != nil {
+		t.Fatalf("unable to post to the trigger: %s", err.Error())
+	}
+	resp.Body.Close()
+	select {
+	case <-fired:
+	case <-time.After(2 * time.Second):
+		t.Errorf("httpTrigger did not fire on the unix socket")
+	}
+}
+
+func TestHTTPTrigger(t *testing.T) {
+	tr := &httpTrigger{fired: make(chan string, 1)}
+
+	rec := httptest.NewRecorder()
+	tr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trigger", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want status %d for GET, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		tr.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/trigger?reason=deploy", nil))
+		if rec.Code != http.StatusAccepted {
+			t.Errorf("want status %d for POST, got %d", http.StatusAccepted, rec.Code)
+		}
+	}
+	select {
+	case reason := <-tr.fired:
+		if !strings.HasSuffix(reason, ": deploy") {
+			t.Errorf("want reason to end with the query, got %s", reason)
+		}
+	default:
+		t.Errorf("httpTrigger did not fire")
+	}
+}
+
+func TestTokenRefresher_waitForTrigger_httpAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	defer l.Close()
+	r := &TokenRefresher{Trigger: TriggerSettings{Names: []string{TriggerHTTP}, HTTPAddr: l.Addr().String()}}
+
+	if _, err := r.waitForTrigger(context.Background(), nil, nil); err == nil || !strings.Contains(err.Error(), TriggerHTTP) {
+		t.Errorf("want an error as the address of the %s trigger is in use, got %v", TriggerHTTP, err)
+	}
+}
+
+func TestScheduleTrigger(t *testing.T) {
+	r := &TokenRefresher{Trigger: TriggerSettings{Schedule: time.Now().Add(100 * time.Millisecond).Format(time.RFC3339Nano)}}
+	tr, err := newScheduleTrigger(TriggerEnv{Refresher: r})
+	if err != nil {
+		t.Fatalf("newScheduleTrigger() failed: %s", err.Error())
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	select {
+	case <-tr.Watch(stopCh):
+	case <-time.After(2 * time.Second):
+		t.Errorf("schedule trigger did not fire at the absolute time")
+	}
+}
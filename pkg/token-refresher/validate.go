@@ -0,0 +1,81 @@
+package tokenrefresher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// MinExpirationDuration is the shortest token expiry accepted by the API server
+const MinExpirationDuration = 10 * time.Minute
+
+// Validate checks the invariants of the config which would otherwise only surface as failing refreshes
+// much later, typically while the pod is already terminating. All problems found are returned joined together.
+func (r *TokenRefresher) Validate() error {
+	var errs []error
+	if r.Namespace == "" && r.needsKube() {
+		errs = append(errs, fmt.Errorf("namespace is required"))
+	}
+	if r.ServiceAccount == "" && r.source == nil && r.Source.name() == SourceTokenRequest {
+		errs = append(errs, fmt.Errorf("service account is required"))
+	}
+	if r.source == nil {
+		if err := r.Source.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if r.DefaultTokenFile == r.TokenFile && r.hasSink(SinkFile) {
+		errs = append(errs, fmt.Errorf("token file must differ from the default token file %s", r.DefaultTokenFile))
+	}
+	if r.expiration() < MinExpirationDuration {
+		errs = append(errs, fmt.Errorf("expiration duration %v must be at least %v", r.expiration(), MinExpirationDuration))
+	}
+	errs = append(errs, r.validateReloadable(r.expiration()))
+	if err := r.Hooks.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid hooks: %w", err))
+	}
+	if err := r.validateSinks(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid sinks: %w", err))
+	}
+	if err := r.validateTriggers(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid triggers: %w", err))
+	}
+	for _, name := range r.Shutdown.Signalers {
+		if name == "" || strings.Contains(name, "/") {
+			errs = append(errs, fmt.Errorf("invalid shutdown signaler name %q", name))
+		}
+	}
+	if err := r.Heartbeat.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.App.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.Admin.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.TokenAPI.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(r.PrimaryContainers) > 0 && r.PodName == "" {
+		errs = append(errs, fmt.Errorf("pod name is required to watch the primary containers"))
+	}
+	if r.TerminationDeadline && r.PodName == "" {
+		errs = append(errs, fmt.Errorf("pod name is required for the termination deadline"))
+	}
+	return errors.Join(errs...)
+}
+
+// CheckShutdownDir verifies that the shutdown file can be created in its directory
+func (r *TokenRefresher) CheckShutdownDir() error {
+	dir := path.Dir(r.shutdownPath())
+	f, err := os.CreateTemp(dir, ShutdownFile)
+	if err != nil {
+		return fmt.Errorf("shutdown file directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,77 @@
+package tokenrefresher
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/SumoLogic-Labs/service-account-token-refresher/pkg/retry"
+)
+
+func TestTokenRefresher_Validate(t *testing.T) {
+	valid := func() *TokenRefresher {
+		return &TokenRefresher{
+			Namespace:          "test-ns",
+			ServiceAccount:     "test-sa",
+			DefaultTokenFile:   "/default/token",
+			TokenFile:          "/refreshed/token",
+			ExpirationDuration: time.Hour * 2,
+			RefreshInterval:    time.Hour,
+			ShutdownInterval:   time.Minute,
+			Retryer:            retry.Retryer{MaxAttempts: 3, Sleep: time.Second},
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(r *TokenRefresher)
+		wantErr bool
+	}{
+		{"Accept valid config", func(r *TokenRefresher) {}, false},
+		{"Reject empty namespace", func(r *TokenRefresher) { r.Namespace = "" }, true},
+		{"Reject empty service account", func(r *TokenRefresher) { r.ServiceAccount = "" }, true},
+		{"Reject expiration below the API server minimum", func(r *TokenRefresher) {
+			r.ExpirationDuration = time.Minute * 5
+			r.RefreshInterval = time.Minute
+		}, true},
+		{"Reject expiration not exceeding 1.5 * refresh interval", func(r *TokenRefresher) { r.ExpirationDuration = time.Minute * 90 }, true},
+		{"Reject non-positive shutdown interval", func(r *TokenRefresher) { r.ShutdownInterval = 0 }, true},
+		{"Reject token file overwriting the default token", func(r *TokenRefresher) { r.TokenFile = r.DefaultTokenFile }, true},
+		{"Reject unknown sink", func(r *TokenRefresher) { r.Sinks = []string{"nowhere"} }, true},
+		{"Reject secret sink without secret name", func(r *TokenRefresher) { r.Sinks = []string{SinkSecret} }, true},
+		{"Accept empty service account for other sources", func(r *TokenRefresher) {
+			r.ServiceAccount = ""
+			r.Source = SourceSettings{Name: SourceExec, Command: "cat /token"}
+		}, false},
+		{"Accept empty namespace for other sources", func(r *TokenRefresher) {
+			r.Namespace = ""
+			r.Source = SourceSettings{Name: SourceFile, File: "/var/run/token"}
+		}, false},
+		{"Reject empty namespace for other sources with the secret sink", func(r *TokenRefresher) {
+			r.Namespace = ""
+			r.Source = SourceSettings{Name: SourceFile, File: "/var/run/token"}
+			r.Sinks = []string{SinkSecret}
+			r.Secret.SecretName = "token"
+		}, true},
+		{"Reject invalid source", func(r *TokenRefresher) { r.Source = SourceSettings{Name: SourceFile} }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.modify(r)
+			if err := r.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenRefresher_CheckShutdownDir(t *testing.T) {
+	r := &TokenRefresher{TokenFile: path.Join(t.TempDir(), "token")}
+	if err := r.CheckShutdownDir(); err != nil {
+		t.Errorf("CheckShutdownDir() failed for a writable directory: %s", err.Error())
+	}
+	r.TokenFile = path.Join(t.TempDir(), "missing", "token")
+	if err := r.CheckShutdownDir(); err == nil {
+		t.Error("CheckShutdownDir() did not fail for a missing directory")
+	}
+}